@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jpbetz/cel-webhook/validators"
+)
+
+var crdFile string
+
+// CmdCheckConversion checks the conversion rules of a CRD against sample custom resources.
+var CmdCheckConversion = &cobra.Command{
+	Use:   "check-conversion --crd <crd-file> <object-file>...",
+	Short: "Checks that custom resources convert to every version of their CRD and back without changes",
+	Long: `Checks that custom resources convert to every version of their CRD and back without changes.
+Each object is converted to every other version of the CRD and back as the webhook converts it,
+including the fields it preserves in annotations, and must be identical once converted back.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runCmdCheckConversion,
+}
+
+func init() {
+	CmdCheckConversion.Flags().StringVar(&crdFile, "crd", "",
+		"File containing the CustomResourceDefinition of the objects.")
+	CmdCheckConversion.MarkFlagRequired("crd")
+}
+
+func runCmdCheckConversion(cmd *cobra.Command, args []string) {
+	validator := newFormatValidators()
+	celValidator := validators.NewCelValidator()
+	validator.registerFormat(celValidatorId, celValidator)
+	validator.registerConverter(celConverterId, celValidator)
+	validator.registerDefaulter(celDefaulterId, celValidator)
+
+	crd, err := validator.loadCrd(crdFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading %s: %v\n", crdFile, err)
+		os.Exit(1)
+	}
+	validator.RegisterCustomResourceDefinition(crd)
+	failed := false
+	for _, status := range validator.statuses.list() {
+		for _, e := range status.CompileErrors {
+			fmt.Printf("FAIL %s: version %s: %s\n", crdFile, e.Version, e)
+			failed = true
+		}
+	}
+	var versions []string
+	for _, version := range crd.Spec.Versions {
+		versions = append(versions, version.Name)
+	}
+	sort.Strings(versions)
+
+	for _, file := range args {
+		cr, err := loadObject(file)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			failed = true
+			continue
+		}
+		for _, version := range versions {
+			if version == cr.GroupVersionKind().Version {
+				continue
+			}
+			if err := validator.checkRoundTrip(context.Background(), cr, version); err != nil {
+				fmt.Printf("FAIL %s: %v\n", file, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("ok   %s: %s -> %s -> %s\n", file, cr.GroupVersionKind().Version, version, cr.GroupVersionKind().Version)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// loadObject reads a custom resource from a YAML or JSON file.
+func loadObject(file string) (*unstructured.Unstructured, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	cr := &unstructured.Unstructured{}
+	if err := cr.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
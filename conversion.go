@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// preservedFieldsAnnotation is the annotation holding the fields of a custom resource that did not
+// survive converting it back to the versions it was converted from, by version, so that they are
+// restored when it is converted back.
+const preservedFieldsAnnotation = "cel-webhook.jpbetz.github.com/preserved-fields"
+
+// preservedField is a field of a custom resource whose value differs once the resource is converted
+// to another version and back.
+type preservedField struct {
+	// Path holds the property names of the field, from the root of the resource.
+	Path []string `json:"path"`
+	// Value is the value of the field, and is unset if the field was absent.
+	Value json.RawMessage `json:"value,omitempty"`
+	// RoundTrip is the value of the field once converted back, and is unset if it was removed. The field
+	// is only restored if converting back still results in this value, so that changes made to the
+	// resource in the other version are never overwritten.
+	RoundTrip json.RawMessage `json:"roundTrip,omitempty"`
+}
+
+// conversionPath returns the versions an object of kind gvk is converted through to reach
+// targetVersion, starting with its own version and ending with targetVersion. Conversions follow
+// the pairs of versions with conversion rules declared at the root of the CRD, so that CRDs with many
+// versions need only declare rules to and from a hub version, or between consecutive versions. The
+// shortest such chain is chosen, preferring the versions that sort first among chains of the same
+// length. Versions with no chain of rules between them are converted directly.
+func (v *formatValidators) conversionPath(gvk schema.GroupVersionKind, targetVersion string) []string {
+	direct := []string{gvk.Version, targetVersion}
+	if current, ok := v.schemaFor(gvk); !ok || current.conversions[targetVersion] != nil {
+		return direct
+	}
+	previous := map[string]string{gvk.Version: ""}
+	queue := []string{gvk.Version}
+	for len(queue) > 0 {
+		version := queue[0]
+		queue = queue[1:]
+		s, ok := v.schemaFor(gvk.GroupKind().WithVersion(version))
+		if !ok {
+			continue
+		}
+		next := make([]string, 0, len(s.conversions))
+		for to := range s.conversions {
+			next = append(next, to)
+		}
+		sort.Strings(next)
+		for _, to := range next {
+			if _, seen := previous[to]; seen {
+				continue
+			}
+			previous[to] = version
+			if to == targetVersion {
+				path := []string{to}
+				for version := previous[to]; version != ""; version = previous[version] {
+					path = append([]string{version}, path...)
+				}
+				return path
+			}
+			queue = append(queue, to)
+		}
+	}
+	return direct
+}
+
+// getPreservedFields returns the fields preserved in the annotation of cr, by version.
+func getPreservedFields(cr *unstructured.Unstructured) (map[string][]preservedField, error) {
+	preserved := map[string][]preservedField{}
+	value, ok := cr.GetAnnotations()[preservedFieldsAnnotation]
+	if !ok {
+		return preserved, nil
+	}
+	if err := json.Unmarshal([]byte(value), &preserved); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", preservedFieldsAnnotation, err)
+	}
+	return preserved, nil
+}
+
+// setPreservedFields sets the annotation of cr to preserved, removing it if there are none.
+func setPreservedFields(cr *unstructured.Unstructured, preserved map[string][]preservedField) error {
+	if len(preserved) == 0 {
+		deletePreservedFields(cr)
+		return nil
+	}
+	value, err := json.Marshal(preserved)
+	if err != nil {
+		return err
+	}
+	annotations := cr.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[preservedFieldsAnnotation] = string(value)
+	cr.SetAnnotations(annotations)
+	return nil
+}
+
+func deletePreservedFields(cr *unstructured.Unstructured) {
+	annotations := cr.GetAnnotations()
+	if _, ok := annotations[preservedFieldsAnnotation]; !ok {
+		return
+	}
+	delete(annotations, preservedFieldsAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	cr.SetAnnotations(annotations)
+}
+
+// lostFields returns the fields of obj, a custom resource or one of its objects at path, whose values
+// differ in back, the same object once converted to another version and back. The type and object
+// meta of the resource are not compared, since they are not converted.
+func lostFields(path []string, obj, back map[string]interface{}) ([]preservedField, error) {
+	keys := make([]string, 0, len(obj)+len(back))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	for key := range back {
+		if _, ok := obj[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var lost []preservedField
+	for _, key := range keys {
+		if len(path) == 0 && isTypeMetaOrObjectMeta(key) {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), key)
+		value, ok := obj[key]
+		backValue, backOk := back[key]
+		m, isMap := value.(map[string]interface{})
+		backM, backIsMap := backValue.(map[string]interface{})
+		if ok && backOk && isMap && backIsMap {
+			fields, err := lostFields(fieldPath, m, backM)
+			if err != nil {
+				return nil, err
+			}
+			lost = append(lost, fields...)
+			continue
+		}
+		if ok && backOk && jsonEqual(value, backValue) {
+			continue
+		}
+		field := preservedField{Path: fieldPath}
+		var err error
+		if ok {
+			if field.Value, err = json.Marshal(value); err != nil {
+				return nil, err
+			}
+		}
+		if backOk {
+			if field.RoundTrip, err = json.Marshal(backValue); err != nil {
+				return nil, err
+			}
+		}
+		lost = append(lost, field)
+	}
+	return lost, nil
+}
+
+// restoreFields sets the preserved fields of obj, a converted custom resource, to their values, unless
+// they were changed since they were preserved.
+func restoreFields(obj map[string]interface{}, fields []preservedField) {
+	for _, field := range fields {
+		current, ok, err := unstructured.NestedFieldNoCopy(obj, field.Path...)
+		if err != nil || ok != (field.RoundTrip != nil) {
+			continue
+		}
+		if ok {
+			var roundTrip interface{}
+			if err := utiljson.Unmarshal(field.RoundTrip, &roundTrip); err != nil || !jsonEqual(current, roundTrip) {
+				continue
+			}
+		}
+		if field.Value == nil {
+			unstructured.RemoveNestedField(obj, field.Path...)
+			continue
+		}
+		var value interface{}
+		if err := utiljson.Unmarshal(field.Value, &value); err != nil {
+			continue
+		}
+		// Fields whose parent is no longer an object cannot be restored.
+		_ = unstructured.SetNestedField(obj, value, field.Path...)
+	}
+}
+
+// jsonEqual returns whether a and b have the same JSON encoding.
+func jsonEqual(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// checkRoundTrip converts cr, a custom resource, to version and back, and returns an error describing
+// the changes, as a JSONPatch, if the result is not identical to cr.
+func (v *formatValidators) checkRoundTrip(ctx context.Context, cr *unstructured.Unstructured, version string) error {
+	gv := schema.GroupVersion{Group: cr.GroupVersionKind().Group, Version: version}
+	converted, err := v.convertObject(ctx, gv.String(), cr.DeepCopy())
+	if err != nil {
+		return fmt.Errorf("converting to %s: %w", version, err)
+	}
+	back, err := v.convertObject(ctx, cr.GetAPIVersion(), converted)
+	if err != nil {
+		return fmt.Errorf("converting back from %s: %w", version, err)
+	}
+	want, err := json.Marshal(cr.Object)
+	if err != nil {
+		return err
+	}
+	got, err := json.Marshal(back.Object)
+	if err != nil {
+		return err
+	}
+	if string(want) == string(got) {
+		return nil
+	}
+	patch, err := json.Marshal(createJSONPatch("", cr.Object, back.Object))
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("converting to %s and back changed the object: %s", version, patch)
+}
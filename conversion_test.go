@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestLostFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		obj      string
+		back     string
+		expected string
+	}{
+		{
+			name:     "unchanged",
+			obj:      `{"spec":{"a":1,"l":[1]}}`,
+			back:     `{"spec":{"a":1,"l":[1]}}`,
+			expected: `null`,
+		},
+		{
+			name:     "dropped field",
+			obj:      `{"spec":{"a":1,"b":{"c":2}}}`,
+			back:     `{"spec":{"a":1}}`,
+			expected: `[{"path":["spec","b"],"value":{"c":2}}]`,
+		},
+		{
+			name:     "added field",
+			obj:      `{"spec":{"a":1}}`,
+			back:     `{"spec":{"a":1,"b":2}}`,
+			expected: `[{"path":["spec","b"],"roundTrip":2}]`,
+		},
+		{
+			name:     "changed field",
+			obj:      `{"spec":{"a":1.5}}`,
+			back:     `{"spec":{"a":1}}`,
+			expected: `[{"path":["spec","a"],"value":1.5,"roundTrip":1}]`,
+		},
+		{
+			name:     "changed list",
+			obj:      `{"spec":{"l":[1,2]}}`,
+			back:     `{"spec":{"l":[1]}}`,
+			expected: `[{"path":["spec","l"],"value":[1,2],"roundTrip":[1]}]`,
+		},
+		{
+			name:     "type and object meta",
+			obj:      `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"w"}}`,
+			back:     `{"apiVersion":"example.com/v2","kind":"Widget","metadata":{"name":"w","annotations":{"a":"b"}}}`,
+			expected: `null`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var obj, back map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.obj), &obj); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.back), &back); err != nil {
+				t.Fatal(err)
+			}
+			lost, err := lostFields(nil, obj, back)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(lost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, b)
+			}
+		})
+	}
+}
+
+func TestRestoreFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		obj      string
+		fields   string
+		expected string
+	}{
+		{
+			name:     "dropped field is restored",
+			obj:      `{"spec":{"a":1}}`,
+			fields:   `[{"path":["spec","b"],"value":{"c":2}}]`,
+			expected: `{"spec":{"a":1,"b":{"c":2}}}`,
+		},
+		{
+			name:     "dropped field set since is kept",
+			obj:      `{"spec":{"a":1,"b":3}}`,
+			fields:   `[{"path":["spec","b"],"value":{"c":2}}]`,
+			expected: `{"spec":{"a":1,"b":3}}`,
+		},
+		{
+			name:     "added field is removed",
+			obj:      `{"spec":{"a":1,"b":2}}`,
+			fields:   `[{"path":["spec","b"],"roundTrip":2}]`,
+			expected: `{"spec":{"a":1}}`,
+		},
+		{
+			name:     "changed field is restored",
+			obj:      `{"spec":{"a":1}}`,
+			fields:   `[{"path":["spec","a"],"value":1.5,"roundTrip":1}]`,
+			expected: `{"spec":{"a":1.5}}`,
+		},
+		{
+			name:     "changed field changed since is kept",
+			obj:      `{"spec":{"a":2}}`,
+			fields:   `[{"path":["spec","a"],"value":1.5,"roundTrip":1}]`,
+			expected: `{"spec":{"a":2}}`,
+		},
+		{
+			name:     "changed field removed since stays removed",
+			obj:      `{"spec":{}}`,
+			fields:   `[{"path":["spec","a"],"value":1.5,"roundTrip":1}]`,
+			expected: `{"spec":{}}`,
+		},
+		{
+			name:     "field whose parent is no longer an object",
+			obj:      `{"spec":1}`,
+			fields:   `[{"path":["spec","b"],"value":2}]`,
+			expected: `{"spec":1}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.obj), &obj); err != nil {
+				t.Fatal(err)
+			}
+			var fields []preservedField
+			if err := json.Unmarshal([]byte(tc.fields), &fields); err != nil {
+				t.Fatal(err)
+			}
+			restoreFields(obj, fields)
+			b, err := json.Marshal(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, b)
+			}
+		})
+	}
+}
+
+// stashTestCRD is a Widget CRD whose v1 declares x and v3 declares y, neither of which v2 declares.
+var stashTestCRD = widgetCRD(
+	[2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"},"x":{"type":"string"}}}}}`},
+	[2]string{"v2", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}`},
+	[2]string{"v3", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"},"y":{"type":"string"}}}}}`},
+)
+
+func TestConvertObjectPreservesFields(t *testing.T) {
+	v := newTestValidators(t, stashTestCRD)
+	ctx := context.Background()
+	convert := func(obj *unstructured.Unstructured, version string) *unstructured.Unstructured {
+		t.Helper()
+		converted, err := v.convertObject(ctx, "example.com/"+version, obj.DeepCopy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return converted
+	}
+	preserved := func(obj *unstructured.Unstructured) string {
+		return obj.GetAnnotations()[preservedFieldsAnnotation]
+	}
+	original := &unstructured.Unstructured{Object: widget(t, "v1", `{"a":"a","x":"x"}`)}
+
+	v2 := convert(original, "v2")
+	if expected := `{"v1":[{"path":["spec","x"],"value":"x"}]}`; preserved(v2) != expected {
+		t.Errorf("expected preserved fields %s, got %s", expected, preserved(v2))
+	}
+	if !reflect.DeepEqual(v2.Object["spec"], map[string]interface{}{"a": "a"}) {
+		t.Errorf("expected spec to be converted, got %v", v2.Object["spec"])
+	}
+	if back := convert(v2, "v1"); !reflect.DeepEqual(back.Object, original.Object) {
+		t.Errorf("expected %v, got %v", original.Object, back.Object)
+	}
+
+	// Fields set in v3 are stashed next to those of v1, and each is restored in its own version.
+	v3 := convert(v2, "v3")
+	if err := unstructured.SetNestedField(v3.Object, "y", "spec", "y"); err != nil {
+		t.Fatal(err)
+	}
+	v2 = convert(v3, "v2")
+	if expected := `{"v1":[{"path":["spec","x"],"value":"x"}],"v3":[{"path":["spec","y"],"value":"y"}]}`; preserved(v2) != expected {
+		t.Errorf("expected preserved fields %s, got %s", expected, preserved(v2))
+	}
+	v1 := convert(v2, "v1")
+	if expected := `{"v3":[{"path":["spec","y"],"value":"y"}]}`; preserved(v1) != expected {
+		t.Errorf("expected preserved fields %s, got %s", expected, preserved(v1))
+	}
+	if x, _, _ := unstructured.NestedString(v1.Object, "spec", "x"); x != "x" {
+		t.Errorf("expected spec.x to be restored, got %q", x)
+	}
+	v3 = convert(v1, "v3")
+	if y, _, _ := unstructured.NestedString(v3.Object, "spec", "y"); y != "y" {
+		t.Errorf("expected spec.y to be restored, got %q", y)
+	}
+	if expected := `{"v1":[{"path":["spec","x"],"value":"x"}]}`; preserved(v3) != expected {
+		t.Errorf("expected preserved fields %s, got %s", expected, preserved(v3))
+	}
+}
+
+func TestConvertObjectPreservedFieldChangedInOtherVersion(t *testing.T) {
+	v := newTestValidators(t, stashTestCRD)
+	ctx := context.Background()
+	v2, err := v.convertObject(ctx, "example.com/v2", &unstructured.Unstructured{Object: widget(t, "v1", `{"x":"x"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// v2 does not declare x, but a field set in v2 where a preserved field was is never overwritten.
+	annotations := v2.GetAnnotations()
+	annotations[preservedFieldsAnnotation] = `{"v1":[{"path":["spec","a"],"value":"old","roundTrip":"a"}]}`
+	v2.SetAnnotations(annotations)
+	if err := unstructured.SetNestedField(v2.Object, "new", "spec", "a"); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := v.convertObject(ctx, "example.com/v1", v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _, _ := unstructured.NestedString(v1.Object, "spec", "a"); a != "new" {
+		t.Errorf("expected spec.a to keep the value set in v2, got %q", a)
+	}
+	if _, ok := v1.GetAnnotations()[preservedFieldsAnnotation]; ok {
+		t.Errorf("expected no preserved fields, got %v", v1.GetAnnotations())
+	}
+}
+
+// oneWayTestCRD is a Widget CRD whose v1 converts to v2, but not back since num is an integer in v1
+// and a string in v2.
+var oneWayTestCRD = widgetCRD(
+	[2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"num":{"type":"integer"}}}}}`},
+	[2]string{"v2", `{"type":"object","properties":{"spec":{"type":"object","properties":{"num":{"type":"string"}}}}}`},
+)
+
+func TestConvertObjectOneWayConverter(t *testing.T) {
+	v := newTestValidators(t, withConverters(t, oneWayTestCRD, `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec.num","rule":"string(self.spec.num)"}]}]`))
+	ctx := context.Background()
+	obj := &unstructured.Unstructured{Object: widget(t, "v1", `{"num":1}`)}
+
+	v2, err := v.convertObject(ctx, "example.com/v2", obj.DeepCopy())
+	if err != nil {
+		t.Fatalf("expected conversion without a reverse converter to succeed, got %v", err)
+	}
+	if num, _, _ := unstructured.NestedString(v2.Object, "spec", "num"); num != "1" {
+		t.Errorf("expected spec.num to be converted, got %q", num)
+	}
+	if _, ok := v2.GetAnnotations()[preservedFieldsAnnotation]; ok {
+		t.Errorf("expected no preserved fields, got %v", v2.GetAnnotations())
+	}
+
+	err = v.checkRoundTrip(ctx, obj, "v2")
+	if err == nil || !strings.Contains(err.Error(), "converting back from v2") {
+		t.Errorf("expected round trip to fail converting back, got %v", err)
+	}
+}
+
+func TestCheckRoundTrip(t *testing.T) {
+	v := newTestValidators(t, stashTestCRD)
+	for _, version := range []string{"v1", "v2", "v3"} {
+		obj := &unstructured.Unstructured{Object: widget(t, "v1", `{"a":"a","x":"x"}`)}
+		if err := v.checkRoundTrip(context.Background(), obj, version); err != nil {
+			t.Errorf("expected round trip through %s to be lossless, got %v", version, err)
+		}
+	}
+}
+
+// hubTestCRD is a Widget CRD whose v1alpha1, v1beta1 and v2 only convert to and from v1, and whose v3
+// converts to no other version.
+var hubTestCRD = widgetCRD(
+	[2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"hub":{"type":"string"}}}}}`},
+	[2]string{"v1alpha1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}`},
+	[2]string{"v1beta1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"b":{"type":"string"}}}}}`},
+	[2]string{"v2", `{"type":"object","properties":{"spec":{"type":"object","properties":{"c":{"type":"integer"}}}}}`},
+	[2]string{"v3", `{"type":"object","properties":{"spec":{"type":"object","properties":{"hub":{"type":"string"}}}}}`},
+)
+
+const hubTestConverters = `
+- {fromVersion: v1alpha1, toVersion: v1, rules: [{field: spec.hub, rule: "self.spec.a"}]}
+- {fromVersion: v1, toVersion: v1alpha1, rules: [{field: spec.a, rule: "self.spec.hub"}]}
+- {fromVersion: v1beta1, toVersion: v1, rules: [{field: spec.hub, rule: "self.spec.b"}]}
+- {fromVersion: v1, toVersion: v1beta1, rules: [{field: spec.b, rule: "self.spec.hub"}]}
+- {fromVersion: v1, toVersion: v2, rules: [{field: spec.c, rule: "int(self.spec.hub)"}]}
+- {fromVersion: v2, toVersion: v1, rules: [{field: spec.hub, rule: "string(self.spec.c)"}]}
+`
+
+func TestConversionPath(t *testing.T) {
+	v := newTestValidators(t, withConverters(t, hubTestCRD, hubTestConverters))
+	tests := []struct {
+		from, to string
+		expected []string
+	}{
+		{from: "v1alpha1", to: "v1", expected: []string{"v1alpha1", "v1"}},
+		{from: "v1", to: "v2", expected: []string{"v1", "v2"}},
+		{from: "v1alpha1", to: "v1beta1", expected: []string{"v1alpha1", "v1", "v1beta1"}},
+		{from: "v2", to: "v1alpha1", expected: []string{"v2", "v1", "v1alpha1"}},
+		{from: "v1", to: "v3", expected: []string{"v1", "v3"}},
+		{from: "v3", to: "v2", expected: []string{"v3", "v2"}},
+		{from: "v9", to: "v1", expected: []string{"v9", "v1"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.from+" to "+tc.to, func(t *testing.T) {
+			path := v.conversionPath(schema.GroupVersionKind{Group: "example.com", Version: tc.from, Kind: "Widget"}, tc.to)
+			if !reflect.DeepEqual(path, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, path)
+			}
+		})
+	}
+}
+
+func TestConvertRequestThroughHub(t *testing.T) {
+	v := newTestValidators(t, withConverters(t, hubTestCRD, hubTestConverters))
+	ctx := context.Background()
+
+	converted := convertedObjects(t, v.convertRequest(ctx, conversionReview(t, "example.com/v2", widget(t, "v1alpha1", `{"a":"42"}`))))
+	if c, _, _ := unstructured.NestedFieldNoCopy(converted[0], "spec", "c"); c != float64(42) {
+		t.Errorf("expected spec.c to be converted through v1, got %v", converted[0]["spec"])
+	}
+	converted = convertedObjects(t, v.convertRequest(ctx, conversionReview(t, "example.com/v1beta1", widget(t, "v2", `{"c":7}`))))
+	if b, _, _ := unstructured.NestedString(converted[0], "spec", "b"); b != "7" {
+		t.Errorf("expected spec.b to be converted through v1, got %v", converted[0]["spec"])
+	}
+
+	resp := v.convertRequest(ctx, conversionReview(t, "example.com/v2", widget(t, "v1beta1", `{"b":"x"}`)))
+	if resp.Result.Status != metav1.StatusFailure || !strings.Contains(resp.Result.Message, "converting from v1 to v2 through v1beta1 -> v1 -> v2") {
+		t.Errorf("expected failing step of the chain to be reported, got %v", resp.Result)
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"errors"
+
 	"k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// toV1AdmissionResponse denies the request with err. API status errors, such as those returned by
+// apierrors.NewInvalid, are returned with their reason, code and details.
 func toV1AdmissionResponse(err error) *v1.AdmissionResponse {
+	var statusErr *apierrors.StatusError
+	if errors.As(err, &statusErr) {
+		status := statusErr.Status()
+		return &v1.AdmissionResponse{Result: &status}
+	}
 	return &v1.AdmissionResponse{
 		Result: &metav1.Status{
 			Message: err.Error(),
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+var (
+	// crdRuleCompileErrors is the number of rules of each registered CustomResourceDefinition that
+	// failed to compile, by CRD name. Published at /debug/vars.
+	crdRuleCompileErrors = expvar.NewMap("crd_rule_compile_errors")
+)
+
+// compileError is a rule of a schema node that failed to compile.
+type compileError struct {
+	Version string `json:"version"`
+	// TargetVersion is set for conversion rules to the version converted to.
+	TargetVersion string `json:"targetVersion,omitempty"`
+	Path          string `json:"path"`
+	Rule          string `json:"rule,omitempty"`
+	Error         string `json:"error"`
+}
+
+func newCompileError(fieldpath []string, rule string, err error) compileError {
+	return compileError{Path: "/" + strings.Join(fieldpath, "/"), Rule: rule, Error: err.Error()}
+}
+
+func (e compileError) String() string {
+	if len(e.Rule) > 0 {
+		return fmt.Sprintf("%s: %s (rule: %s)", e.Path, e.Error, e.Rule)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Error)
+}
+
+// crdStatus records the outcome of compiling the rules of a registered CustomResourceDefinition.
+type crdStatus struct {
+	Name          string         `json:"name"`
+	UID           types.UID      `json:"uid"`
+	Generation    int64          `json:"generation"`
+	CompileErrors []compileError `json:"compileErrors,omitempty"`
+	// converters and rules are the annotations the rules were compiled from. Changes to annotations
+	// do not change the generation of the CRD.
+	converters string
+	rules      string
+}
+
+// crdStatuses holds the status of each registered CustomResourceDefinition, by name.
+type crdStatuses struct {
+	lock     sync.RWMutex
+	statuses map[string]*crdStatus
+}
+
+func newCRDStatuses() *crdStatuses {
+	return &crdStatuses{statuses: map[string]*crdStatus{}}
+}
+
+func (s *crdStatuses) set(status *crdStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statuses[status.Name] = status
+	crdRuleCompileErrors.Add(status.Name, 0)
+	crdRuleCompileErrors.Get(status.Name).(*expvar.Int).Set(int64(len(status.CompileErrors)))
+	for _, e := range status.CompileErrors {
+		klog.Errorf("rule compile error for %s (generation %d) version %s: %s", status.Name, status.Generation, e.Version, e)
+	}
+}
+
+func (s *crdStatuses) get(name string) (*crdStatus, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	status, ok := s.statuses[name]
+	return status, ok
+}
+
+func (s *crdStatuses) delete(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.statuses, name)
+	crdRuleCompileErrors.Delete(name)
+}
+
+// list returns the statuses of all registered CustomResourceDefinitions ordered by name.
+func (s *crdStatuses) list() []*crdStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var statuses []*crdStatus
+	for _, status := range s.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// serveCRDStatus serves the statuses of all registered CustomResourceDefinitions. With ?errors=true
+// only those with rules that failed to compile are listed.
+func (s *crdStatuses) serveCRDStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := []*crdStatus{}
+	for _, status := range s.list() {
+		if r.URL.Query().Get("errors") == "true" && len(status.CompileErrors) == 0 {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	respBytes, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		klog.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(respBytes); err != nil {
+		klog.Error(err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jpbetz/cel-webhook/validators"
+)
+
+func TestServeCRDStatus(t *testing.T) {
+	v := newFormatValidators()
+	v.registerFormat(celValidatorId, validators.NewCelValidator())
+	registerTestCRD(t, v, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{
+		"a":{"type":"integer"}}}}}`}), `[{"version":"v1","field":"spec.a","validations":[{"rule":"self > 0"},{"rule":"self > 'x'"}]}]`))
+	registerTestCRD(t, v, strings.Replace(widgetCRD([2]string{"v1", `{"type":"object"}`}), "widgets", "gadgets", -1))
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{url: "/debug/crds", expected: []string{"gadgets.example.com", "widgets.example.com: v1 /spec/a: self > 'x'"}},
+		{url: "/debug/crds?errors=true", expected: []string{"widgets.example.com: v1 /spec/a: self > 'x'"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			v.statuses.serveCRDStatus(w, httptest.NewRequest("GET", tc.url, nil))
+			var statuses []*crdStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, status := range statuses {
+				s := status.Name
+				for _, e := range status.CompileErrors {
+					s += fmt.Sprintf(": %s %s: %s", e.Version, e.Path, e.Rule)
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+	if got := crdRuleCompileErrors.Get("widgets.example.com").String(); got != "1" {
+		t.Errorf("expected 1 compile error to be published, got %s", got)
+	}
+}
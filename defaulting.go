@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	v1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog"
+
+	"github.com/jpbetz/cel-webhook/validators"
+)
+
+// maxDefaultingPasses bounds the number of times the defaults of an object are applied. Each pass
+// may only add properties, so objects converge after a few passes unless defaults depend on each
+// other in long chains.
+const maxDefaultingPasses = 10
+
+func (v *formatValidators) serveMutateRequest(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, v.mutateRequest, nil)
+}
+
+// mutateRequest prunes and defaults the custom resource being admitted, returning the changes as a
+// JSONPatch. The default rules evaluated share the runtime cost budget of the request.
+func (v *formatValidators) mutateRequest(ctx context.Context, ar v1.AdmissionReview) *v1.AdmissionResponse {
+	ctx = validators.WithRuntimeCostBudget(ctx)
+	reviewResponse := &v1.AdmissionResponse{Allowed: true}
+	obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+	if err := json.Unmarshal(ar.Request.Object.Raw, &obj); err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	crd, ok := v.schemaFor(obj.GroupVersionKind())
+	if !ok {
+		return reviewResponse
+	}
+
+	defaulted := obj.DeepCopy()
+	if err := v.mutateObject(ctx, crd, defaulted); err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	patch := createJSONPatch("", obj.Object, defaulted.Object)
+	if len(patch) == 0 {
+		return reviewResponse
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		klog.Error(err)
+		return toV1AdmissionResponse(err)
+	}
+	patchType := v1.PatchTypeJSONPatch
+	reviewResponse.Patch = patchBytes
+	reviewResponse.PatchType = &patchType
+	return reviewResponse
+}
+
+// mutateObject prunes and defaults obj, a custom resource, as the apiserver does when persisting it.
+// Unknown fields are pruned again once obj is defaulted, since defaults may hold fields the schema
+// does not declare.
+func (v *formatValidators) mutateObject(ctx context.Context, crd *crdSchema, obj *unstructured.Unstructured) error {
+	pruning := v.pruneUnknownFields && !crd.preserveUnknownFields
+	if pruning {
+		prune(crd.Schema, obj.Object, true)
+	}
+	if err := v.defaultObject(ctx, crd, obj); err != nil {
+		return err
+	}
+	if pruning {
+		prune(crd.Schema, obj.Object, true)
+	}
+	return nil
+}
+
+// defaultObject applies the defaults of crd to obj, a custom resource. Defaults are applied until
+// they no longer change obj, so that applying them again to the result, as the apiserver does when a
+// later webhook changes the object, is a no-op. Returns an Invalid error if any default fails, or a
+// Forbidden error if the defaults exceed the runtime cost budget of ctx.
+func (v *formatValidators) defaultObject(ctx context.Context, crd *crdSchema, obj *unstructured.Unstructured) error {
+	for pass := 1; ; pass++ {
+		changed, errs := v.defaultObj(ctx, nil, nil, crd.CRDVersion, crd.Schema, crd.extensions, obj.Object, obj.Object)
+		if ctx.Err() != nil {
+			return apierrors.NewTimeoutError(fmt.Sprintf("defaulting of %s %q did not complete: %v", obj.GetKind(), obj.GetName(), ctx.Err()), 0)
+		}
+		if costErr := validators.RuntimeCostBudgetErr(ctx); costErr != nil {
+			return apierrors.NewForbidden(crd.resource, obj.GetName(), costErr)
+		}
+		if !changed {
+			if len(errs) > 0 {
+				return apierrors.NewInvalid(obj.GroupVersionKind().GroupKind(), obj.GetName(), errs)
+			}
+			return nil
+		}
+		if pass == maxDefaultingPasses {
+			return apierrors.NewInternalError(fmt.Errorf("defaults of %s %q did not converge after %d passes", obj.GetKind(), obj.GetName(), maxDefaultingPasses))
+		}
+	}
+}
+
+// defaultObj sets the absent properties of obj that have a default, and then those of its
+// descendants, so that defaults of nested properties apply within defaulted objects. Properties of
+// an object are defaulted in the order of their names, and default rules see the defaults already
+// applied. fieldpath identifies the schema node, while fldPath is the path of obj reported in
+// failures. Returns whether obj was changed and the defaults that failed.
+func (v *formatValidators) defaultObj(ctx context.Context, fieldpath []string, fldPath *field.Path, crd validators.CRDVersion, schema *apiextensionsv1.JSONSchemaProps, ext *schemaExtensions, root, obj interface{}) (bool, field.ErrorList) {
+	var changed bool
+	var errs field.ErrorList
+	if evaluationStopped(ctx) {
+		return false, nil
+	}
+	switch schema.Type {
+	case "object":
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return false, nil
+		}
+		propNames := make([]string, 0, len(schema.Properties))
+		for propName := range schema.Properties {
+			propNames = append(propNames, propName)
+		}
+		sort.Strings(propNames)
+		for _, propName := range propNames {
+			prop := schema.Properties[propName]
+			d := propertyDefault(&prop, ext.property(propName))
+			if d == nil || m[propName] != nil {
+				continue
+			}
+			value, err := v.defaultValue(ctx, fieldpath, propName, crd, schema, d, root, m)
+			if err != nil {
+				if evaluationStopped(ctx) {
+					return changed, errs
+				}
+				// Rules that fail to compile are reported when the CRD is registered.
+				var compileErr *validators.CompileError
+				if errors.As(err, &compileErr) {
+					klog.V(4).Infof("skipping default that failed to compile: %v", err)
+					continue
+				}
+				errs = append(errs, field.Invalid(fldPath.Child(propName), prop.Type, err.Error()))
+				continue
+			}
+			if value != nil {
+				m[propName] = value
+				changed = true
+			}
+		}
+		for _, propName := range propNames {
+			if propObj, ok := m[propName]; ok {
+				prop := schema.Properties[propName]
+				propChanged, propErrs := v.defaultObj(ctx, append(fieldpath, propName), fldPath.Child(propName), crd, &prop, ext.property(propName), root, propObj)
+				changed = changed || propChanged
+				errs = append(errs, propErrs...)
+			}
+		}
+		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+			keys := make([]string, 0, len(m))
+			for key := range m {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				valueChanged, valueErrs := v.defaultObj(ctx, append(fieldpath, "value"), fldPath.Key(key), crd, schema.AdditionalProperties.Schema, ext.additionalProperties(), root, m[key])
+				changed = changed || valueChanged
+				errs = append(errs, valueErrs...)
+			}
+		}
+	case "array":
+		items, ok := obj.([]interface{})
+		if !ok || schema.Items == nil || schema.Items.Schema == nil {
+			return false, nil
+		}
+		for i, item := range items {
+			itemChanged, itemErrs := v.defaultObj(ctx, append(fieldpath, "item"), fldPath.Index(i), crd, schema.Items.Schema, ext.items(), root, item)
+			changed = changed || itemChanged
+			errs = append(errs, itemErrs...)
+		}
+	}
+	return changed, errs
+}
+
+// propertyDefault returns the default of a property: its default in the rules annotation, if any, or
+// else its schema default.
+func propertyDefault(prop *apiextensionsv1.JSONSchemaProps, ext *schemaExtensions) *validators.DefaultRule {
+	if d := ext.defaultRule(); d != nil {
+		return d
+	}
+	if prop.Default != nil {
+		return &validators.DefaultRule{Value: prop.Default}
+	}
+	return nil
+}
+
+// defaultValue returns the default of the property propName of obj, or nil if it has none.
+func (v *formatValidators) defaultValue(ctx context.Context, fieldpath []string, propName string, crd validators.CRDVersion, schema *apiextensionsv1.JSONSchemaProps, d *validators.DefaultRule, root, obj interface{}) (interface{}, error) {
+	if d.Value != nil {
+		var value interface{}
+		if err := utiljson.Unmarshal(d.Value.Raw, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	defaulter, ok := v.defaulters[celDefaulterId]
+	if !ok {
+		return nil, nil
+	}
+	return defaulter.Default(ctx, fieldpath, propName, d.Rule, crd, schema, root, obj)
+}
+
+// validateDefault checks the default in the rules annotation of the property propName of an object
+// schema node, compiling its rule. Schema defaults are validated by the apiserver. Returns the
+// defaults that are invalid.
+func (v *formatValidators) validateDefault(fieldpath []string, propName string, crd validators.CRDVersion, schema *apiextensionsv1.JSONSchemaProps, d *validators.DefaultRule) []compileError {
+	if d == nil {
+		return nil
+	}
+	path := append(append([]string{}, fieldpath...), propName)
+	if err := validateDefaultRule(*d); err != nil {
+		return []compileError{newCompileError(path, d.Rule, err)}
+	}
+	prop := schema.Properties[propName]
+	if prop.Default != nil {
+		return []compileError{newCompileError(path, d.Rule, fmt.Errorf("rules: default cannot be combined with the default of the schema"))}
+	}
+	if d.Value != nil {
+		var value interface{}
+		if err := utiljson.Unmarshal(d.Value.Raw, &value); err != nil {
+			return []compileError{newCompileError(path, "", fmt.Errorf("rules: invalid default value: %w", err))}
+		}
+		if err := validators.CheckType(&prop, value); err != nil {
+			return []compileError{newCompileError(path, "", fmt.Errorf("rules: invalid default value: %w", err))}
+		}
+		return nil
+	}
+	if defaulter, ok := v.defaulters[celDefaulterId]; ok {
+		if err := defaulter.ValidateDefault(fieldpath, propName, d.Rule, crd, schema); err != nil {
+			return []compileError{newCompileError(path, d.Rule, err)}
+		}
+	}
+	return nil
+}
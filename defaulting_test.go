@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestMutateRequestDefaults(t *testing.T) {
+	tests := []struct {
+		name          string
+		specSchema    string
+		rules         string
+		spec          string
+		expectedPatch string
+		expectedErr   string
+	}{
+		{
+			name:          "schema default and static value",
+			specSchema:    `{"type":"object","properties":{"a":{"type":"integer","default":1},"b":{"type":"string"}}}`,
+			rules:         `[{"version":"v1","field":"spec.b","default":{"value":"x"}}]`,
+			spec:          `{}`,
+			expectedPatch: `[{"op":"add","path":"/spec/a","value":1},{"op":"add","path":"/spec/b","value":"x"}]`,
+		},
+		{
+			name:       "present properties are not defaulted",
+			specSchema: `{"type":"object","properties":{"a":{"type":"integer","default":1}}}`,
+			spec:       `{"a":2}`,
+		},
+		{
+			name:          "rule sees defaults of earlier properties",
+			specSchema:    `{"type":"object","properties":{"minReplicas":{"type":"integer"},"replicas":{"type":"integer"}}}`,
+			rules:         `[{"version":"v1","field":"spec.minReplicas","default":{"value":1}},{"version":"v1","field":"spec.replicas","default":{"rule":"self.minReplicas"}}]`,
+			spec:          `{}`,
+			expectedPatch: `[{"op":"add","path":"/spec/minReplicas","value":1},{"op":"add","path":"/spec/replicas","value":1}]`,
+		},
+		{
+			name:          "rule sees defaults of later properties in the next pass",
+			specSchema:    `{"type":"object","properties":{"a":{"type":"integer"},"b":{"type":"integer"}}}`,
+			rules:         `[{"version":"v1","field":"spec.a","default":{"rule":"has(self.b) ? self.b + 1 : dyn(null)"}},{"version":"v1","field":"spec.b","default":{"value":1}}]`,
+			spec:          `{}`,
+			expectedPatch: `[{"op":"add","path":"/spec/a","value":2},{"op":"add","path":"/spec/b","value":1}]`,
+		},
+		{
+			name:          "nested defaults apply within defaulted objects",
+			specSchema:    `{"type":"object","properties":{"o":{"type":"object","default":{},"properties":{"a":{"type":"integer","default":1}}}}}`,
+			spec:          `{}`,
+			expectedPatch: `[{"op":"add","path":"/spec/o","value":{"a":1}}]`,
+		},
+		{
+			name:          "defaults of list items",
+			specSchema:    `{"type":"object","properties":{"l":{"type":"array","items":{"type":"object","properties":{"a":{"type":"integer","default":1}}}}}}`,
+			spec:          `{"l":[{},{"a":2}]}`,
+			expectedPatch: `[{"op":"add","path":"/spec/l/0/a","value":1}]`,
+		},
+		{
+			name:          "unknown fields are pruned",
+			specSchema:    `{"type":"object","properties":{"a":{"type":"integer"}}}`,
+			spec:          `{"a":1,"b":2}`,
+			expectedPatch: `[{"op":"remove","path":"/spec/b"}]`,
+		},
+		{
+			name:        "failing rule",
+			specSchema:  `{"type":"object","properties":{"x":{"type":"integer"},"y":{"type":"integer"},"q":{"type":"integer"}}}`,
+			rules:       `[{"version":"v1","field":"spec.q","default":{"rule":"self.x / self.y"}}]`,
+			spec:        `{"x":1,"y":0}`,
+			expectedErr: "spec.q",
+		},
+		{
+			name:        "rule evaluating to the wrong type",
+			specSchema:  `{"type":"object","properties":{"s":{"type":"string"},"q":{"type":"integer"}}}`,
+			rules:       `[{"version":"v1","field":"spec.q","default":{"rule":"dyn(self.s)"}}]`,
+			spec:        `{"s":"x"}`,
+			expectedErr: "spec.q",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":` + tc.specSchema + `}}`}), tc.rules))
+			obj := widget(t, "v1", tc.spec)
+
+			resp := v.mutateRequest(context.Background(), admissionReview(t, v1.Create, obj, nil))
+			if tc.expectedErr != "" {
+				if resp.Allowed || resp.Result == nil || !strings.Contains(resp.Result.Message, tc.expectedErr) {
+					t.Fatalf("expected failure containing %q, got %v", tc.expectedErr, resp.Result)
+				}
+				return
+			}
+			if !resp.Allowed {
+				t.Fatalf("expected mutation to be allowed, got %v", resp.Result)
+			}
+			if string(resp.Patch) != tc.expectedPatch {
+				t.Errorf("expected patch %s, got %s", tc.expectedPatch, resp.Patch)
+			}
+
+			// Mutating the result again, as the apiserver does when a later webhook changes the
+			// object, must be a no-op.
+			crd, _ := v.schemaFor((&unstructured.Unstructured{Object: obj}).GroupVersionKind())
+			mutated := &unstructured.Unstructured{Object: obj}
+			if err := v.mutateObject(context.Background(), crd, mutated); err != nil {
+				t.Fatal(err)
+			}
+			resp = v.mutateRequest(context.Background(), admissionReview(t, v1.Update, mutated.Object, obj))
+			if !resp.Allowed || resp.Patch != nil {
+				t.Errorf("expected no patch for the mutated object, got %s (%v)", resp.Patch, resp.Result)
+			}
+		})
+	}
+}
+
+func TestValidateRequestDoesNotDefault(t *testing.T) {
+	v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"integer"}}}}}`}),
+		`[{"version":"v1","field":"spec","validations":[{"rule":"has(self.a)"}]},{"version":"v1","field":"spec.a","default":{"value":1}}]`))
+
+	resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, widget(t, "v1", `{}`), nil))
+	if resp.Allowed {
+		t.Errorf("expected the object to be validated as received, without its defaults")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"github.com/jpbetz/cel-webhook/validators"
+)
+
+const (
+	// rulesAnnotation is the annotation of a CustomResourceDefinition holding the validation rules and
+	// defaults of its schema nodes. Like conversion rules, they are declared in an annotation since
+	// apiservers drop the vendor extensions, such as x-kubernetes-validations, that the CRD API does
+	// not model.
+	rulesAnnotation = "cel-webhook.jpbetz.github.com/rules"
+	// convertersAnnotation is the annotation of a CustomResourceDefinition holding its conversion rules.
+	// The CRD API has no field for them, so an annotation is used, which apiservers retain.
+	convertersAnnotation = "cel-webhook.jpbetz.github.com/converters"
+)
+
+// validationRuleReasons are the reasons a validation rule may report on failure.
+var validationRuleReasons = map[string]bool{
+	"FieldValueInvalid":   true,
+	"FieldValueForbidden": true,
+	"FieldValueRequired":  true,
+	"FieldValueDuplicate": true,
+}
+
+// schemaExtensions holds the rules of a schema node and its descendants, as read from the rules
+// annotation of a CustomResourceDefinition, and is walked alongside the JSONSchemaProps. A nil
+// *schemaExtensions is valid and has no rules.
+type schemaExtensions struct {
+	Validations          []validators.ValidationRule
+	Default              *validators.DefaultRule
+	Properties           map[string]*schemaExtensions
+	Items                *schemaExtensions
+	AdditionalProperties *schemaExtensions
+}
+
+func (e *schemaExtensions) validations() []validators.ValidationRule {
+	if e == nil {
+		return nil
+	}
+	return e.Validations
+}
+
+func (e *schemaExtensions) defaultRule() *validators.DefaultRule {
+	if e == nil {
+		return nil
+	}
+	return e.Default
+}
+
+func (e *schemaExtensions) property(name string) *schemaExtensions {
+	if e == nil {
+		return nil
+	}
+	return e.Properties[name]
+}
+
+func (e *schemaExtensions) items() *schemaExtensions {
+	if e == nil {
+		return nil
+	}
+	return e.Items
+}
+
+func (e *schemaExtensions) additionalProperties() *schemaExtensions {
+	if e == nil {
+		return nil
+	}
+	return e.AdditionalProperties
+}
+
+// schemaRules are the validation rules and default of a schema node, as declared by an entry of the
+// rules annotation.
+type schemaRules struct {
+	Version string `json:"version"`
+	// Field is the path of the schema node from the root of the object: property names separated by
+	// '.', each followed by a "[*]" for every level of array items or map values, e.g.
+	// spec.ports[*].port. The root is an empty path.
+	Field       string                      `json:"field,omitempty"`
+	Validations []validators.ValidationRule `json:"validations,omitempty"`
+	// Default is the default of the node, which must be a property.
+	Default *validators.DefaultRule `json:"default,omitempty"`
+}
+
+// parseSchemaExtensions returns the rules of each version of crd, keyed by version name, as read from
+// the rules annotation, which holds a YAML or JSON list of schemaRules. Entries that do not name a
+// schema node of crd are returned as compile errors, while the rules of all other entries are kept.
+func parseSchemaExtensions(crd *apiextensionsv1.CustomResourceDefinition) (map[string]*schemaExtensions, []compileError, error) {
+	annotation, ok := crd.Annotations[rulesAnnotation]
+	if !ok {
+		return nil, nil, nil
+	}
+	var entries []schemaRules
+	if err := yaml.Unmarshal([]byte(annotation), &entries); err != nil {
+		return nil, nil, fmt.Errorf("error decoding rules of %s annotation: %w", rulesAnnotation, err)
+	}
+	schemas := map[string]*apiextensionsv1.JSONSchemaProps{}
+	for _, version := range crd.Spec.Versions {
+		if version.Schema != nil && version.Schema.OpenAPIV3Schema != nil {
+			schemas[version.Name] = version.Schema.OpenAPIV3Schema
+		}
+	}
+	extensions := map[string]*schemaExtensions{}
+	var errs []compileError
+	seen := map[[2]string]bool{}
+	for _, entry := range entries {
+		fieldpath, err := splitField(entry.Field)
+		if err == nil {
+			err = addSchemaRules(extensions, schemas, entry, fieldpath, seen)
+		}
+		if err != nil {
+			e := newCompileError(fieldpath, "", err)
+			e.Version = entry.Version
+			errs = append(errs, e)
+		}
+	}
+	return extensions, errs, nil
+}
+
+// addSchemaRules adds the validation rules and default of entry to the schema node at fieldpath of its
+// version.
+// seen holds the versions and fields of the entries already added.
+func addSchemaRules(extensions map[string]*schemaExtensions, schemas map[string]*apiextensionsv1.JSONSchemaProps, entry schemaRules, fieldpath []string, seen map[[2]string]bool) error {
+	s, ok := schemas[entry.Version]
+	if !ok {
+		return fmt.Errorf("rules: version %q is not a version with a schema", entry.Version)
+	}
+	key := [2]string{entry.Version, strings.Join(fieldpath, ".")}
+	if seen[key] {
+		return fmt.Errorf("rules: duplicate entry for field %q", entry.Field)
+	}
+	seen[key] = true
+	if entry.Default != nil && (len(fieldpath) == 0 || fieldpath[len(fieldpath)-1] == "[*]") {
+		return fmt.Errorf("rules: default must be set on a property, but field %q is not one", entry.Field)
+	}
+	if extensions[entry.Version] == nil {
+		extensions[entry.Version] = &schemaExtensions{}
+	}
+	node, err := extensions[entry.Version].node(s, fieldpath)
+	if err != nil {
+		return err
+	}
+	node.Validations = entry.Validations
+	node.Default = entry.Default
+	return nil
+}
+
+// splitField splits the field of a rules annotation entry into property names and "[*]" segments.
+func splitField(field string) ([]string, error) {
+	if len(field) == 0 {
+		return nil, nil
+	}
+	var fieldpath []string
+	for _, segment := range strings.Split(field, ".") {
+		name, levels := segment, 0
+		for strings.HasSuffix(name, "[*]") {
+			name, levels = strings.TrimSuffix(name, "[*]"), levels+1
+		}
+		if len(name) == 0 {
+			return nil, fmt.Errorf("rules: field must be a path of property names separated by '.', but got %q", field)
+		}
+		fieldpath = append(fieldpath, name)
+		for ; levels > 0; levels-- {
+			fieldpath = append(fieldpath, "[*]")
+		}
+	}
+	return fieldpath, nil
+}
+
+// node returns the extensions of the descendant of e at fieldpath, as split by splitField, adding it
+// if needed. s is the schema of e.
+func (e *schemaExtensions) node(s *apiextensionsv1.JSONSchemaProps, fieldpath []string) (*schemaExtensions, error) {
+	for _, segment := range fieldpath {
+		switch {
+		case segment != "[*]":
+			prop, ok := s.Properties[segment]
+			if !ok {
+				return nil, fmt.Errorf("rules: property %q is not declared by the schema", segment)
+			}
+			if e.Properties == nil {
+				e.Properties = map[string]*schemaExtensions{}
+			}
+			if e.Properties[segment] == nil {
+				e.Properties[segment] = &schemaExtensions{}
+			}
+			e, s = e.Properties[segment], &prop
+		case s.Items != nil && s.Items.Schema != nil:
+			if e.Items == nil {
+				e.Items = &schemaExtensions{}
+			}
+			e, s = e.Items, s.Items.Schema
+		case s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil:
+			if e.AdditionalProperties == nil {
+				e.AdditionalProperties = &schemaExtensions{}
+			}
+			e, s = e.AdditionalProperties, s.AdditionalProperties.Schema
+		default:
+			return nil, fmt.Errorf("rules: [*] must follow an array or a map, but the schema has neither items nor additionalProperties")
+		}
+	}
+	return e, nil
+}
+
+// parseConversionRules decodes the conversion rules declared, as YAML or JSON, by the converters
+// annotation of a CustomResourceDefinition.
+func parseConversionRules(crd *apiextensionsv1.CustomResourceDefinition) ([]validators.ConversionRules, error) {
+	converters, ok := crd.Annotations[convertersAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var conversions []validators.ConversionRules
+	if err := yaml.Unmarshal([]byte(converters), &conversions); err != nil {
+		return nil, fmt.Errorf("error decoding conversion rules of %s annotation: %w", convertersAnnotation, err)
+	}
+	return conversions, nil
+}
+
+// validateRule checks the fields of a validation rule, other than the rule expression itself.
+func validateRule(rule validators.ValidationRule) error {
+	if len(strings.TrimSpace(rule.Rule)) == 0 {
+		return fmt.Errorf("rules: rule must not be empty")
+	}
+	if len(rule.Reason) > 0 && !validationRuleReasons[rule.Reason] {
+		return fmt.Errorf("rules: unsupported reason %q for rule: %s", rule.Reason, rule.Rule)
+	}
+	if len(rule.FieldPath) > 0 && !strings.HasPrefix(rule.FieldPath, ".") {
+		return fmt.Errorf("rules: fieldPath must be a path relative to the schema node starting with '.', but got %q for rule: %s", rule.FieldPath, rule.Rule)
+	}
+	return nil
+}
+
+// validateFieldConversionRule checks the field of a conversion rule and that it has a rule.
+func validateFieldConversionRule(rule validators.FieldConversionRule) error {
+	if len(strings.TrimSpace(rule.Rule)) == 0 {
+		return fmt.Errorf("converters: rule must not be empty")
+	}
+	path := rule.Path()
+	for _, propName := range path {
+		if len(propName) == 0 {
+			return fmt.Errorf("converters: field must be a path of property names separated by '.', but got %q", rule.Field)
+		}
+	}
+	if isTypeMetaOrObjectMeta(path[0]) {
+		return fmt.Errorf("converters: field %s cannot be set by conversion rules", rule.Field)
+	}
+	return nil
+}
+
+// validateDefaultRule checks that a default has either a value or a rule.
+func validateDefaultRule(d validators.DefaultRule) error {
+	hasRule := len(strings.TrimSpace(d.Rule)) > 0
+	if (d.Value != nil) == hasRule {
+		return fmt.Errorf("rules: default must set exactly one of value or rule")
+	}
+	return nil
+}
@@ -1,55 +1,224 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/ghodss/yaml"
 	v1 "k8s.io/api/admission/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/klog"
 
 	"github.com/jpbetz/cel-webhook/validators"
 )
 
+// celValidatorId is the id of the FormatValidator that evaluates the rules of the rules annotation.
+const celValidatorId = "validation"
+
+// celConverterId is the id of the Converter that evaluates conversion rules. Conversion rules declared
+// at the root of a CustomResourceDefinition are run by it if it is also an ObjectConverter.
+const celConverterId = "conversion"
+
+// celDefaulterId is the id of the Defaulter that evaluates the default rules of the rules annotation.
+const celDefaulterId = "default"
+
 type RegisterAware interface {
 	RegisterCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition)
+	UnregisterCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition)
+}
+
+// crdSchema is the schema of a registered version of a CustomResourceDefinition.
+type crdSchema struct {
+	validators.CRDVersion
+	extensions *schemaExtensions
+	// resource is the resource of the custom resources, reported when they are rejected.
+	resource schema.GroupResource
+	// preserveUnknownFields is set for CustomResourceDefinitions whose unknown fields are never pruned.
+	preserveUnknownFields bool
+	// conversions holds the conversion rules from this version declared at the root of the
+	// CustomResourceDefinition, by the version they convert to.
+	conversions map[string]*validators.ConversionRules
 }
 
 type formatValidators struct {
 	validators map[string]validators.FormatValidator
 	converters map[string]validators.Converter
-	crdSchemas map[schema.GroupVersionKind]*apiextensionsv1.CustomResourceDefinitionVersion
+	defaulters map[string]validators.Defaulter
+
+	lock       sync.RWMutex
+	crdSchemas map[schema.GroupVersionKind]*crdSchema
+	// crdKinds holds the kinds of the versions registered for each CustomResourceDefinition, by name.
+	crdKinds map[string][]schema.GroupVersionKind
+	statuses *crdStatuses
+
+	// legacyFormatRules enables rules declared in the format of schema nodes as
+	// "<FormatValidator-id>:<FormatValidator-specific-content>".
+	legacyFormatRules bool
+	// pruneUnknownFields enables the pruning of fields not declared by the schema of custom resources
+	// when the mutating webhook defaults them.
+	pruneUnknownFields bool
 }
 
 func newFormatValidators() *formatValidators {
 	v := &formatValidators{}
 	v.validators = map[string]validators.FormatValidator{}
 	v.converters = map[string]validators.Converter{}
-	v.crdSchemas = map[schema.GroupVersionKind]*apiextensionsv1.CustomResourceDefinitionVersion{}
+	v.defaulters = map[string]validators.Defaulter{}
+	v.crdSchemas = map[schema.GroupVersionKind]*crdSchema{}
+	v.crdKinds = map[string][]schema.GroupVersionKind{}
+	v.statuses = newCRDStatuses()
+	v.legacyFormatRules = true
+	v.pruneUnknownFields = true
 	return v
 }
 
+// RegisterCustomResourceDefinition registers the schemas of all versions of crd, replacing those of
+// any previous generation, and compiles all its rules. CRDs that are already registered with the
+// same UID, generation, validation rules and conversion rules, such as those resynced by the
+// informer, are not compiled again.
 func (v *formatValidators) RegisterCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) {
+	if status, ok := v.statuses.get(crd.Name); ok && status.UID == crd.UID && status.Generation == crd.Generation &&
+		status.converters == crd.Annotations[convertersAnnotation] && status.rules == crd.Annotations[rulesAnnotation] {
+		return
+	}
+	extensions, ruleErrs, err := parseSchemaExtensions(crd)
+	if err != nil {
+		klog.Errorf("ignoring rules of %s: %v", crd.Name, err)
+	}
+	conversions, err := parseConversionRules(crd)
+	if err != nil {
+		klog.Errorf("ignoring conversion rules of %s: %v", crd.Name, err)
+	}
+	v.notifyRegisterAware(func(r RegisterAware) { r.RegisterCustomResourceDefinition(crd) })
+
+	schemas := map[schema.GroupVersionKind]*crdSchema{}
 	for _, version := range crd.Spec.Versions {
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
 		gvk := schema.GroupVersionKind{Group: crd.Spec.Group, Version: version.Name, Kind: crd.Spec.Names.Kind}
-		cp := version
-		v.crdSchemas[gvk] = &cp
+		schemas[gvk] = &crdSchema{
+			CRDVersion: validators.CRDVersion{
+				UID:        crd.UID,
+				Generation: crd.Generation,
+				Version:    version.Name,
+				Schema:     version.Schema.OpenAPIV3Schema,
+			},
+			extensions:            extensions[version.Name],
+			resource:              schema.GroupResource{Group: crd.Spec.Group, Resource: crd.Spec.Names.Plural},
+			preserveUnknownFields: crd.Spec.PreserveUnknownFields,
+			conversions:           map[string]*validators.ConversionRules{},
+		}
 	}
+	for i, c := range conversions {
+		if s, ok := schemas[schema.GroupVersionKind{Group: crd.Spec.Group, Version: c.FromVersion, Kind: crd.Spec.Names.Kind}]; ok {
+			s.conversions[c.ToVersion] = &conversions[i]
+		}
+	}
+
+	v.lock.Lock()
+	for _, gvk := range v.crdKinds[crd.Name] {
+		delete(v.crdSchemas, gvk)
+	}
+	v.crdKinds[crd.Name] = nil
+	for gvk, s := range schemas {
+		v.crdSchemas[gvk] = s
+		v.crdKinds[crd.Name] = append(v.crdKinds[crd.Name], gvk)
+	}
+	v.lock.Unlock()
+
+	status := &crdStatus{Name: crd.Name, UID: crd.UID, Generation: crd.Generation, converters: crd.Annotations[convertersAnnotation], rules: crd.Annotations[rulesAnnotation]}
+	status.CompileErrors = append(ruleErrs, v.compileRules(schemas, conversions)...)
+	v.statuses.set(status)
+}
+
+// UnregisterCustomResourceDefinition removes the schemas of all versions of crd.
+func (v *formatValidators) UnregisterCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) {
+	v.lock.Lock()
+	for _, gvk := range v.crdKinds[crd.Name] {
+		delete(v.crdSchemas, gvk)
+	}
+	delete(v.crdKinds, crd.Name)
+	v.lock.Unlock()
+	v.statuses.delete(crd.Name)
+
+	v.notifyRegisterAware(func(r RegisterAware) { r.UnregisterCustomResourceDefinition(crd) })
+}
+
+func (v *formatValidators) notifyRegisterAware(notify func(r RegisterAware)) {
+	notified := map[RegisterAware]bool{}
 	for _, validator := range v.validators {
-		if r, ok := validator.(RegisterAware); ok {
-			r.RegisterCustomResourceDefinition(crd)
+		if r, ok := validator.(RegisterAware); ok && !notified[r] {
+			notify(r)
+			notified[r] = true
+		}
+	}
+	for _, converter := range v.converters {
+		if r, ok := converter.(RegisterAware); ok && !notified[r] {
+			notify(r)
+			notified[r] = true
+		}
+	}
+	for _, defaulter := range v.defaulters {
+		if r, ok := defaulter.(RegisterAware); ok && !notified[r] {
+			notify(r)
+			notified[r] = true
 		}
 	}
 }
 
+// compileRules compiles the validation rules and defaults of all versions and the conversion rules
+// between all pairs of versions, so that they are ready before the first request that needs them.
+// Returns the rules that failed to compile.
+func (v *formatValidators) compileRules(schemas map[schema.GroupVersionKind]*crdSchema, conversions []validators.ConversionRules) []compileError {
+	versions := map[string]validators.CRDVersion{}
+	for _, s := range schemas {
+		versions[s.Version] = s.CRDVersion
+	}
+	errs := v.validateConversionRules(versions, conversions)
+	for _, s := range schemas {
+		for _, e := range v.validatePrograms(nil, s.CRDVersion, s.Schema, s.extensions) {
+			e.Version = s.Version
+			errs = append(errs, e)
+		}
+		for _, target := range schemas {
+			if target == s {
+				continue
+			}
+			for _, e := range v.validateConversions(nil, s.CRDVersion, target.CRDVersion, s.Schema, target.Schema) {
+				e.Version = s.Version
+				e.TargetVersion = target.Version
+				errs = append(errs, e)
+			}
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return fmt.Sprint(errs[i].Version, errs[i].TargetVersion, errs[i].Path) < fmt.Sprint(errs[j].Version, errs[j].TargetVersion, errs[j].Path)
+	})
+	return errs
+}
+
+// schemaFor returns the registered schema of gvk.
+func (v *formatValidators) schemaFor(gvk schema.GroupVersionKind) (*crdSchema, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	s, ok := v.crdSchemas[gvk]
+	return s, ok
+}
+
 func (v *formatValidators) registerFormat(validatorId string, formatValidator validators.FormatValidator) {
 	v.validators[validatorId] = formatValidator
 }
@@ -58,6 +227,10 @@ func (v *formatValidators) registerConverter(converterId string, converter valid
 	v.converters[converterId] = converter
 }
 
+func (v *formatValidators) registerDefaulter(defaulterId string, defaulter validators.Defaulter) {
+	v.defaulters[defaulterId] = defaulter
+}
+
 func (v *formatValidators) loadCrd(crdfilepath string) (*apiextensionsv1.CustomResourceDefinition, error) {
 	b, err := os.ReadFile(crdfilepath)
 	if err != nil {
@@ -72,62 +245,48 @@ func (v *formatValidators) loadCrd(crdfilepath string) (*apiextensionsv1.CustomR
 }
 
 func (v *formatValidators) serveValidateRequest(w http.ResponseWriter, r *http.Request) {
-	serve(w, r, v.validateRequest, v.convertRequest)
+	serve(w, r, v.validateRequest, nil)
 }
 
-func (v *formatValidators) convertRequest(convertRequest apiextensionsv1.ConversionReview) *apiextensionsv1.ConversionResponse {
-	var convertedObjects []runtime.RawExtension
-	for _, obj := range convertRequest.Request.Objects {
+func (v *formatValidators) serveConvertRequest(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, nil, v.convertRequest)
+}
+
+// convertRequest converts each of the objects of a ConversionReview to the desired version. The
+// apiserver requires exactly one converted object per requested object, in order, so the request
+// fails, naming each object that could not be converted and why, unless all objects convert. The
+// rules evaluated for all objects share the runtime cost budget of the request, and the request fails
+// with the budget's error alone once it is exceeded.
+func (v *formatValidators) convertRequest(ctx context.Context, convertRequest apiextensionsv1.ConversionReview) *apiextensionsv1.ConversionResponse {
+	ctx = validators.WithRuntimeCostBudget(ctx)
+	desiredAPIVersion := convertRequest.Request.DesiredAPIVersion
+	convertedObjects := make([]runtime.RawExtension, 0, len(convertRequest.Request.Objects))
+	var failures []string
+	for i, obj := range convertRequest.Request.Objects {
 		cr := unstructured.Unstructured{}
 		if err := cr.UnmarshalJSON(obj.Raw); err != nil {
+			failures = append(failures, fmt.Sprintf("object %d: %v", i, err))
+			continue
+		}
+		convertedCR, err := v.convertObject(ctx, desiredAPIVersion, &cr)
+		if costErr := validators.RuntimeCostBudgetErr(ctx); costErr != nil {
+			msg := fmt.Sprintf("failed to convert %d objects to %s: %v", len(convertRequest.Request.Objects), desiredAPIVersion, costErr)
+			klog.Info(msg)
 			return &apiextensionsv1.ConversionResponse{
-				Result: metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}, // TODO: distinguish between client and server errors
+				Result: metav1.Status{Status: metav1.StatusFailure, Message: msg},
 			}
 		}
-
-		currentGVK := cr.GroupVersionKind()
-		targetGVK := schema.FromAPIVersionAndKind(convertRequest.Request.DesiredAPIVersion, currentGVK.Kind)
-		if targetCrd, ok := v.crdSchemas[targetGVK]; ok {
-			if currentCrd, ok := v.crdSchemas[currentGVK]; ok {
-				klog.Infof("converting from %v to %v (%s to %s)", currentGVK, targetGVK, currentCrd.Name, targetCrd.Name)
-				converted, err := v.convertObj(nil, currentGVK.Version, targetGVK.Version, currentCrd.Schema.OpenAPIV3Schema, targetCrd.Schema.OpenAPIV3Schema, cr.Object)
-				if err != nil {
-					klog.Infof("Conversion error for %v to %v: %v", currentGVK, targetGVK, err)
-					return &apiextensionsv1.ConversionResponse{
-						Result: metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}, // TODO: distinguish between client and server errors
-					}
-				}
-				out, ok := converted.(map[string]interface{})
-				if !ok {
-					return &apiextensionsv1.ConversionResponse{
-						Result: metav1.Status{Reason: metav1.StatusFailure, Message: fmt.Sprintf("Expected map in conversion response but got %T", converted)},
-					}
-				}
-				convertedCR := &unstructured.Unstructured{Object: out}
-				convertedCR.SetAPIVersion(convertRequest.Request.DesiredAPIVersion)
-				convertedCR.SetKind(cr.GetKind())
-
-				convertedCR.SetName(cr.GetName())
-				convertedCR.SetGenerateName(cr.GetGenerateName())
-				convertedCR.SetNamespace(cr.GetNamespace())
-				convertedCR.SetSelfLink(cr.GetSelfLink())
-				convertedCR.SetUID(cr.GetUID())
-				convertedCR.SetResourceVersion(cr.GetResourceVersion())
-				convertedCR.SetGeneration(cr.GetGeneration())
-				convertedCR.SetNamespace(cr.GetNamespace())
-				convertedCR.SetCreationTimestamp(cr.GetCreationTimestamp())
-				convertedCR.SetDeletionTimestamp(cr.GetDeletionTimestamp())
-				convertedCR.SetDeletionGracePeriodSeconds(cr.GetDeletionGracePeriodSeconds())
-				convertedCR.SetLabels(cr.GetLabels())
-				convertedCR.SetAnnotations(cr.GetAnnotations())
-				convertedCR.SetOwnerReferences(cr.GetOwnerReferences())
-				convertedCR.SetFinalizers(cr.GetFinalizers())
-				convertedCR.SetClusterName(cr.GetClusterName())
-				convertedCR.SetManagedFields(cr.GetManagedFields())
-
-				// TODO: handle all object meta
-				convertedObjects = append(convertedObjects, runtime.RawExtension{Object: convertedCR})
-			}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s %s: %v", cr.GetKind(), objectName(&cr), err))
+			continue
+		}
+		convertedObjects = append(convertedObjects, runtime.RawExtension{Object: convertedCR})
+	}
+	if len(failures) > 0 {
+		msg := fmt.Sprintf("failed to convert %d of %d objects to %s: %s", len(failures), len(convertRequest.Request.Objects), desiredAPIVersion, strings.Join(failures, "; "))
+		klog.Info(msg)
+		return &apiextensionsv1.ConversionResponse{
+			Result: metav1.Status{Status: metav1.StatusFailure, Message: msg}, // TODO: distinguish between client and server errors
 		}
 	}
 	return &apiextensionsv1.ConversionResponse{
@@ -138,7 +297,149 @@ func (v *formatValidators) convertRequest(convertRequest apiextensionsv1.Convers
 	}
 }
 
-func (v *formatValidators) validateRequest(ar v1.AdmissionReview) *v1.AdmissionResponse {
+// convertObject converts cr, a custom resource, to desiredAPIVersion. Objects already at
+// desiredAPIVersion are returned unchanged. Fields that do not survive converting the object back are
+// preserved in an annotation of the converted object, and restored when it is converted back; none
+// are preserved if the object cannot be converted back. Finding the lost fields runs the converters
+// back along the reverse path, so each conversion evaluates about twice as many rules, charged to
+// the runtime cost budget and the deadline of ctx, as the forward conversion alone. Returns an error
+// if either version is not served by a registered CRD or if the conversion fails.
+func (v *formatValidators) convertObject(ctx context.Context, desiredAPIVersion string, cr *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if cr.GetAPIVersion() == desiredAPIVersion {
+		return cr, nil
+	}
+	currentGVK := cr.GroupVersionKind()
+	targetGVK := schema.FromAPIVersionAndKind(desiredAPIVersion, currentGVK.Kind)
+	if _, ok := v.schemaFor(currentGVK); !ok {
+		return nil, fmt.Errorf("no CRD with a schema for %v is registered", currentGVK)
+	}
+	if _, ok := v.schemaFor(targetGVK); !ok {
+		return nil, fmt.Errorf("no CRD with a schema for %v is registered", targetGVK)
+	}
+	preserved, err := getPreservedFields(cr)
+	if err != nil {
+		return nil, err
+	}
+	in := cr.DeepCopy()
+	deletePreservedFields(in)
+	converted, err := v.convertPath(ctx, in, v.conversionPath(currentGVK, targetGVK.Version))
+	if err != nil {
+		return nil, err
+	}
+	restoreFields(converted.Object, preserved[targetGVK.Version])
+	delete(preserved, targetGVK.Version)
+
+	// Converters need not be reversible, so an object that cannot be converted back is still
+	// converted, without preserving the fields it loses.
+	back, err := v.convertPath(ctx, converted.DeepCopy(), v.conversionPath(targetGVK, currentGVK.Version))
+	if err != nil {
+		klog.Warningf("not preserving the fields of %s lost in conversion from %s to %s: converting back failed: %v", objectName(cr), currentGVK.Version, targetGVK.Version, err)
+		delete(preserved, currentGVK.Version)
+	} else {
+		lost, err := lostFields(nil, in.Object, back.Object)
+		if err != nil {
+			return nil, err
+		}
+		if len(lost) > 0 {
+			preserved[currentGVK.Version] = lost
+		} else {
+			delete(preserved, currentGVK.Version)
+		}
+	}
+	if err := setPreservedFields(converted, preserved); err != nil {
+		return nil, err
+	}
+	return converted, nil
+}
+
+// convertPath converts cr, a custom resource, through path, the versions returned by conversionPath.
+func (v *formatValidators) convertPath(ctx context.Context, cr *unstructured.Unstructured, path []string) (*unstructured.Unstructured, error) {
+	gvk := cr.GroupVersionKind()
+	klog.V(2).Infof("converting %s from %v to %s through %s", objectName(cr), gvk, path[len(path)-1], strings.Join(path, " -> "))
+	converted := cr
+	for i := 1; i < len(path); i++ {
+		current, ok := v.schemaFor(gvk.GroupKind().WithVersion(path[i-1]))
+		if !ok {
+			return nil, fmt.Errorf("no CRD with a schema for version %s is registered", path[i-1])
+		}
+		target, ok := v.schemaFor(gvk.GroupKind().WithVersion(path[i]))
+		if !ok {
+			return nil, fmt.Errorf("no CRD with a schema for version %s is registered", path[i])
+		}
+		var err error
+		converted, err = v.convertVersion(ctx, current, target, converted)
+		if err != nil {
+			if len(path) > 2 {
+				return nil, fmt.Errorf("converting from %s to %s through %s: %w", path[i-1], path[i], strings.Join(path, " -> "), err)
+			}
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// convertVersion converts cr, a custom resource, from the current version to the target version of
+// its CRD.
+func (v *formatValidators) convertVersion(ctx context.Context, currentCrd, targetCrd *crdSchema, cr *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	rules, ok := currentCrd.conversions[targetCrd.Version]
+	converter, hasConverter := v.converters[celConverterId].(validators.ObjectConverter)
+	mapped := map[string]bool{}
+	if ok && hasConverter {
+		for _, rule := range rules.Rules {
+			mapped[rule.Field] = true
+		}
+	}
+	converted, err := v.convertObj(ctx, nil, currentCrd.CRDVersion, targetCrd.CRDVersion, currentCrd.Schema, targetCrd.Schema, mapped, cr.Object)
+	if err != nil {
+		return nil, err
+	}
+	out, ok := converted.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected map in conversion response but got %T", converted)
+	}
+	if len(mapped) > 0 {
+		if err := converter.ConvertObject(ctx, *rules, currentCrd.CRDVersion, targetCrd.CRDVersion, cr.Object, out); err != nil {
+			return nil, err
+		}
+	}
+	convertedCR := &unstructured.Unstructured{Object: out}
+	convertedCR.SetAPIVersion(schema.GroupVersion{Group: cr.GroupVersionKind().Group, Version: targetCrd.Version}.String())
+	convertedCR.SetKind(cr.GetKind())
+
+	convertedCR.SetName(cr.GetName())
+	convertedCR.SetGenerateName(cr.GetGenerateName())
+	convertedCR.SetNamespace(cr.GetNamespace())
+	convertedCR.SetSelfLink(cr.GetSelfLink())
+	convertedCR.SetUID(cr.GetUID())
+	convertedCR.SetResourceVersion(cr.GetResourceVersion())
+	convertedCR.SetGeneration(cr.GetGeneration())
+	convertedCR.SetCreationTimestamp(cr.GetCreationTimestamp())
+	convertedCR.SetDeletionTimestamp(cr.GetDeletionTimestamp())
+	convertedCR.SetDeletionGracePeriodSeconds(cr.GetDeletionGracePeriodSeconds())
+	convertedCR.SetLabels(cr.GetLabels())
+	convertedCR.SetAnnotations(cr.GetAnnotations())
+	convertedCR.SetOwnerReferences(cr.GetOwnerReferences())
+	convertedCR.SetFinalizers(cr.GetFinalizers())
+	convertedCR.SetClusterName(cr.GetClusterName())
+	convertedCR.SetManagedFields(cr.GetManagedFields())
+
+	// TODO: handle all object meta
+	return convertedCR, nil
+}
+
+// objectName returns the namespace/name of a custom resource, or its name if it is cluster scoped.
+func objectName(cr *unstructured.Unstructured) string {
+	if ns := cr.GetNamespace(); ns != "" {
+		return ns + "/" + cr.GetName()
+	}
+	return cr.GetName()
+}
+
+// validateRequest validates the custom resource being admitted, or the rules of the
+// CustomResourceDefinition being admitted. The rules evaluated for a custom resource share the
+// runtime cost budget of the request.
+func (v *formatValidators) validateRequest(ctx context.Context, ar v1.AdmissionReview) *v1.AdmissionResponse {
+	ctx = validators.WithRuntimeCostBudget(ctx)
 	if ar.Request.Kind.String() == apiextensionsv1.SchemeGroupVersion.WithKind("CustomResourceDefinition").String() {
 		crd := apiextensionsv1.CustomResourceDefinition{}
 		raw := ar.Request.Object.Raw
@@ -147,12 +448,51 @@ func (v *formatValidators) validateRequest(ar v1.AdmissionReview) *v1.AdmissionR
 			klog.Error(err)
 			return toV1AdmissionResponse(err)
 		}
+		extensions, ruleErrs, err := parseSchemaExtensions(&crd)
+		if err != nil {
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		if len(ruleErrs) > 0 {
+			var msgs []string
+			for _, e := range ruleErrs {
+				msgs = append(msgs, fmt.Sprintf("version %s: %s", e.Version, e))
+			}
+			err = fmt.Errorf("invalid rules: %s", strings.Join(msgs, "; "))
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		versions := map[string]validators.CRDVersion{}
 		for _, version := range crd.Spec.Versions {
-			err = v.validatePrograms(nil, version.Schema.OpenAPIV3Schema)
-			if err != nil {
+			if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+				continue
+			}
+			// The UID is left empty so that the programs of a CRD that may yet be rejected are not cached.
+			crdVersion := validators.CRDVersion{Version: version.Name, Schema: version.Schema.OpenAPIV3Schema}
+			if errs := v.validatePrograms(nil, crdVersion, version.Schema.OpenAPIV3Schema, extensions[version.Name]); len(errs) > 0 {
+				var msgs []string
+				for _, e := range errs {
+					msgs = append(msgs, e.String())
+				}
+				err = fmt.Errorf("invalid rules in version %s: %s", version.Name, strings.Join(msgs, "; "))
 				klog.Error(err)
 				return toV1AdmissionResponse(err)
 			}
+			versions[version.Name] = crdVersion
+		}
+		conversions, err := parseConversionRules(&crd)
+		if err != nil {
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		if errs := v.validateConversionRules(versions, conversions); len(errs) > 0 {
+			var msgs []string
+			for _, e := range errs {
+				msgs = append(msgs, fmt.Sprintf("from %s to %s: %s", e.Version, e.TargetVersion, e))
+			}
+			err = fmt.Errorf("invalid conversion rules: %s", strings.Join(msgs, "; "))
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
 		}
 	}
 
@@ -164,130 +504,459 @@ func (v *formatValidators) validateRequest(ar v1.AdmissionReview) *v1.AdmissionR
 		return toV1AdmissionResponse(err)
 	}
 
-	if crd, ok := v.crdSchemas[obj.GroupVersionKind()]; ok {
-		err = v.validateObj(nil, crd.Schema.OpenAPIV3Schema, obj.Object)
+	// old remains nil unless this is an update, which disables transition rules.
+	var old *unstructured.Unstructured
+	if ar.Request.Operation == v1.Update && len(ar.Request.OldObject.Raw) > 0 {
+		old = &unstructured.Unstructured{Object: map[string]interface{}{}}
+		err = json.Unmarshal(ar.Request.OldObject.Raw, old)
 		if err != nil {
 			klog.Error(err)
 			return toV1AdmissionResponse(err)
 		}
 	}
 
+	if crd, ok := v.schemaFor(obj.GroupVersionKind()); ok {
+		// Rules are evaluated against the objects as received. The apiserver has already pruned them and
+		// applied the defaults of the schema, and applies the defaults of the rules annotation only if
+		// the mutating endpoint is configured.
+		var oldObj interface{}
+		if old != nil {
+			oldObj = old.Object
+		}
+		errs := v.validateObj(ctx, nil, nil, crd.CRDVersion, crd.Schema, crd.extensions, obj.Object, obj.Object, oldObj)
+		if ctx.Err() != nil {
+			err = apierrors.NewTimeoutError(fmt.Sprintf("validation of %s %q did not complete: %v", obj.GetKind(), obj.GetName(), ctx.Err()), 0)
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		if costErr := validators.RuntimeCostBudgetErr(ctx); costErr != nil {
+			err = apierrors.NewForbidden(crd.resource, obj.GetName(), costErr)
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+		if len(errs) > 0 {
+			err = apierrors.NewInvalid(obj.GroupVersionKind().GroupKind(), obj.GetName(), errs)
+			klog.Error(err)
+			return toV1AdmissionResponse(err)
+		}
+	}
+
 	reviewResponse := v1.AdmissionResponse{}
 	reviewResponse.Allowed = true
 	return &reviewResponse
 }
 
-func (v *formatValidators) validatePrograms(fieldpath []string, schema *apiextensionsv1.JSONSchemaProps) error {
-	if len(schema.Format) > 0 {
+// rule is a validation rule of a schema node and the id of the FormatValidator that runs it.
+type rule struct {
+	validatorId string
+	validators.ValidationRule
+}
+
+// rules returns the validation rules declared on a schema node. Formats that do not name a registered
+// FormatValidator are standard OpenAPI formats and are not rules.
+func (v *formatValidators) rules(schema *apiextensionsv1.JSONSchemaProps, ext *schemaExtensions) []rule {
+	var rules []rule
+	if v.legacyFormatRules && len(schema.Format) > 0 {
 		parts := strings.SplitN(schema.Format, ":", 2)
-		if len(parts) < 2 {
-			return fmt.Errorf("expected format of the form <FormatValidator-id>:<FormatValidator-specific-content>, but got %s", schema.Format)
-		}
-		validatorId := parts[0]
-		validatorSpecificContent := parts[1]
-		if validator, ok := v.validators[validatorId]; ok {
-			if err := validator.ValidateProgram(fieldpath, validatorSpecificContent, schema); err != nil {
-				return err
+		if _, ok := v.validators[parts[0]]; ok && len(parts) == 2 {
+			rules = append(rules, rule{validatorId: parts[0], ValidationRule: validators.ValidationRule{Rule: parts[1]}})
+		}
+	}
+	for _, validation := range ext.validations() {
+		rules = append(rules, rule{validatorId: celValidatorId, ValidationRule: validation})
+	}
+	return rules
+}
+
+// validatePrograms compiles the rules and defaults of schema and all its descendants. Returns the
+// rules that failed to compile.
+func (v *formatValidators) validatePrograms(fieldpath []string, crd validators.CRDVersion, schema *apiextensionsv1.JSONSchemaProps, ext *schemaExtensions) []compileError {
+	var errs []compileError
+	for _, r := range v.rules(schema, ext) {
+		if err := validateRule(r.ValidationRule); err != nil {
+			errs = append(errs, newCompileError(fieldpath, r.Rule, err))
+			continue
+		}
+		if validator, ok := v.validators[r.validatorId]; ok {
+			if err := validator.ValidateProgram(fieldpath, r.ValidationRule, crd, schema); err != nil {
+				errs = append(errs, newCompileError(fieldpath, r.Rule, err))
 			}
 		}
 	}
 	if schema.Type == "object" {
 		for propName, prop := range schema.Properties {
-			if err := v.validatePrograms(append(fieldpath, propName), &prop); err != nil {
-				return err
-			}
+			errs = append(errs, v.validateDefault(fieldpath, propName, crd, schema, ext.property(propName).defaultRule())...)
+			errs = append(errs, v.validatePrograms(append(fieldpath, propName), crd, &prop, ext.property(propName))...)
+		}
+		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+			errs = append(errs, v.validatePrograms(append(fieldpath, "value"), crd, schema.AdditionalProperties.Schema, ext.additionalProperties())...)
 		}
 	}
 	if schema.Type == "array" {
 		if schema.Items == nil {
-			return fmt.Errorf("expected items to be non-nil for array type")
-		}
-		if err := v.validatePrograms(append(fieldpath, "item"), schema.Items.Schema); err != nil {
-			return err
+			return append(errs, newCompileError(fieldpath, "", fmt.Errorf("expected items to be non-nil for array type")))
 		}
+		errs = append(errs, v.validatePrograms(append(fieldpath, "item"), crd, schema.Items.Schema, ext.items())...)
 	}
-	return nil
+	return errs
 }
 
-func (v *formatValidators) validateObj(fieldpath []string, schema *apiextensionsv1.JSONSchemaProps, obj interface{}) error {
-	if len(schema.Format) > 0 {
-		parts := strings.SplitN(schema.Format, ":", 2)
-		if len(parts) < 2 {
-			return fmt.Errorf("expected format of the form <FormatValidator-id>:<FormatValidator-specific-content>, but got %s", schema.Format)
-		}
-		validatorId := parts[0]
-		validatorSpecificContent := parts[1]
-		validator, ok := v.validators[validatorId]
+// validateObj runs the validators of schema and all its descendants against obj and returns all
+// failures. fieldpath identifies the schema node, with "item" for array items and "value" for map
+// values, while fldPath is the path of obj in the custom resource reported in failures. oldObj is
+// the value of the same schema node in the object being updated, or nil if there is none. The walk
+// stops once ctx is done or the runtime cost budget it holds is exceeded.
+func (v *formatValidators) validateObj(ctx context.Context, fieldpath []string, fldPath *field.Path, crd validators.CRDVersion, schema *apiextensionsv1.JSONSchemaProps, ext *schemaExtensions, root, obj, oldObj interface{}) field.ErrorList {
+	var errs field.ErrorList
+	for _, r := range v.rules(schema, ext) {
+		validator, ok := v.validators[r.validatorId]
 		if !ok {
-			return nil // ignore unsupported validators
+			continue // ignore unsupported validators
+		}
+		if evaluationStopped(ctx) {
+			return errs
 		}
-		// TODO: use real fieldpaths, i.e. structured-merge-diff ones
-		if err := validator.Validate(fieldpath, validatorSpecificContent, schema, obj); err != nil {
-			return err
+		if err := validate(ctx, validator, fieldpath, r.ValidationRule, crd, schema, root, obj, oldObj); err != nil {
+			if evaluationStopped(ctx) {
+				return errs
+			}
+			// Rules that fail to compile are reported when the CRD is registered and must not reject
+			// every write.
+			var compileErr *validators.CompileError
+			if errors.As(err, &compileErr) {
+				klog.V(4).Infof("skipping rule that failed to compile: %v", err)
+				continue
+			}
+			errs = append(errs, ruleError(r.ValidationRule, fldPath, schema, err))
 		}
 	}
+	if evaluationStopped(ctx) {
+		return errs
+	}
 	if schema.Type == "object" {
 		if m, ok := obj.(map[string]interface{}); ok { // TODO: should return error if not
-			for propName, prop := range schema.Properties {
+			oldM, _ := oldObj.(map[string]interface{})
+			// Properties and keys are sorted so that failures are reported in a stable order.
+			propNames := make([]string, 0, len(schema.Properties))
+			for propName := range schema.Properties {
+				propNames = append(propNames, propName)
+			}
+			sort.Strings(propNames)
+			for _, propName := range propNames {
 				if propObj, ok := m[propName]; ok {
-					if err := v.validateObj(append(fieldpath, propName), &prop, propObj); err != nil {
-						return err
-					}
+					prop := schema.Properties[propName]
+					errs = append(errs, v.validateObj(ctx, append(fieldpath, propName), fldPath.Child(propName), crd, &prop, ext.property(propName), root, propObj, oldM[propName])...)
+				}
+			}
+			if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+				keys := make([]string, 0, len(m))
+				for key := range m {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					errs = append(errs, v.validateObj(ctx, append(fieldpath, "value"), fldPath.Key(key), crd, schema.AdditionalProperties.Schema, ext.additionalProperties(), root, m[key], oldM[key])...)
 				}
 			}
 		}
 	}
 	if schema.Type == "array" {
 		if schema.Items == nil {
-			return fmt.Errorf("expected items to be non-nil for array type")
+			return append(errs, field.InternalError(fldPath, fmt.Errorf("expected items to be non-nil for array type")))
 		}
 		if items, ok := obj.([]interface{}); ok { // TODO: should return error if not
-			for _, item := range items {
-				if err := v.validateObj(append(fieldpath, "item"), schema.Items.Schema, item); err != nil {
-					return err
+			oldItems := newListMapIndex(schema, oldObj)
+			for i, item := range items {
+				errs = append(errs, v.validateObj(ctx, append(fieldpath, "item"), fldPath.Index(i), crd, schema.Items.Schema, ext.items(), root, item, oldItems.get(item))...)
+			}
+		}
+	}
+	return errs
+}
+
+// evaluationStopped returns whether no more rules may be evaluated with ctx, because it is done or
+// the runtime cost budget it holds is exceeded.
+func evaluationStopped(ctx context.Context) bool {
+	return ctx.Err() != nil || validators.RuntimeCostBudgetErr(ctx) != nil
+}
+
+// validate runs a validation rule with ctx if the validator supports it.
+func validate(ctx context.Context, validator validators.FormatValidator, fieldpath []string, rule validators.ValidationRule, crd validators.CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj, oldObj interface{}) error {
+	if cv, ok := validator.(validators.ContextFormatValidator); ok {
+		return cv.ValidateContext(ctx, fieldpath, rule, crd, schema, root, obj, oldObj)
+	}
+	return validator.Validate(fieldpath, rule, crd, schema, root, obj, oldObj)
+}
+
+// convert runs a conversion rule with ctx if the converter supports it.
+func convert(ctx context.Context, converter validators.Converter, fieldpath []string, content string, current, target validators.CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error) {
+	if cc, ok := converter.(validators.ContextConverter); ok {
+		return cc.ConvertContext(ctx, fieldpath, content, current, target, currentSchema, targetSchema, obj)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("conversion interrupted: %w", err)
+	}
+	return converter.Convert(fieldpath, content, current, target, currentSchema, targetSchema, obj)
+}
+
+// ruleError returns the failure of a rule of the schema node at fldPath, reported against the
+// rule's fieldPath, if any, with the rule's reason.
+func ruleError(rule validators.ValidationRule, fldPath *field.Path, schema *apiextensionsv1.JSONSchemaProps, err error) *field.Error {
+	if len(rule.FieldPath) > 0 {
+		for _, propName := range strings.Split(strings.TrimPrefix(rule.FieldPath, "."), ".") {
+			fldPath = fldPath.Child(propName)
+			if schema != nil {
+				if prop, ok := schema.Properties[propName]; ok {
+					schema = &prop
+				} else {
+					schema = nil
 				}
 			}
 		}
 	}
+	// As for the apiserver's own schema validation, the type of the field is reported instead of its
+	// value, which may be large.
+	var fieldType string
+	if schema != nil {
+		fieldType = schema.Type
+	}
+	switch rule.Reason {
+	case string(field.ErrorTypeForbidden):
+		return field.Forbidden(fldPath, err.Error())
+	case string(field.ErrorTypeRequired):
+		return field.Required(fldPath, err.Error())
+	case string(field.ErrorTypeDuplicate):
+		return &field.Error{Type: field.ErrorTypeDuplicate, Field: fldPath.String(), BadValue: fieldType, Detail: err.Error()}
+	default:
+		return field.Invalid(fldPath, fieldType, err.Error())
+	}
+}
+
+// listMapIndex correlates the items of a list with x-kubernetes-list-type=map to the items of the
+// old list that have the same values for all the x-kubernetes-list-map-keys.
+type listMapIndex struct {
+	keys  []string
+	items map[string]interface{}
+}
+
+// newListMapIndex indexes the items of oldObj. Items of lists of any other type are never
+// correlated since their identity is not defined across updates.
+func newListMapIndex(schema *apiextensionsv1.JSONSchemaProps, oldObj interface{}) *listMapIndex {
+	oldItems, ok := oldObj.([]interface{})
+	if !ok || schema.XListType == nil || *schema.XListType != "map" || len(schema.XListMapKeys) == 0 {
+		return nil
+	}
+	index := &listMapIndex{keys: schema.XListMapKeys, items: map[string]interface{}{}}
+	for _, oldItem := range oldItems {
+		if key, ok := index.key(oldItem); ok {
+			index.items[key] = oldItem
+		}
+	}
+	return index
+}
+
+func (i *listMapIndex) key(item interface{}) (string, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	values := make([]interface{}, len(i.keys))
+	for j, k := range i.keys {
+		values[j] = m[k]
+	}
+	key, err := json.Marshal(values)
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// get returns the old item with the same keys as item, or nil if there is none.
+func (i *listMapIndex) get(item interface{}) interface{} {
+	if i == nil {
+		return nil
+	}
+	if key, ok := i.key(item); ok {
+		return i.items[key]
+	}
 	return nil
 }
 
-func (v *formatValidators) convertObj(fieldpath []string, currentVersion, targetVersion string, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error) {
-	if len(targetSchema.Format) > 0 {
-		parts := strings.SplitN(targetSchema.Format, ":", 3)
-		if len(parts) < 2 {
-			return nil, fmt.Errorf("expected format of the form <id>:from=v1:<content>, but got %s", targetSchema.Format)
+// conversionRule parses a conversion rule declared in a format as <id>:from=<version>:<content>.
+// Returns false if the format does not name a registered Converter.
+func (v *formatValidators) conversionRule(format string) (converter validators.Converter, from, content string, ok bool, err error) {
+	parts := strings.SplitN(format, ":", 3)
+	converter, ok = v.converters[parts[0]]
+	if !ok {
+		return nil, "", "", false, nil
+	}
+	if len(parts) < 3 || !strings.HasPrefix(parts[1], "from=") {
+		return nil, "", "", false, fmt.Errorf("expected format of the form <id>:from=v1:<content>, but got %s", format)
+	}
+	return converter, strings.TrimPrefix(parts[1], "from="), parts[2], true, nil
+}
+
+// validateConversions compiles the conversion rules from the current version declared in the target
+// schema and all its descendants. Returns the rules that failed to compile.
+func (v *formatValidators) validateConversions(fieldpath []string, current, target validators.CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps) []compileError {
+	var errs []compileError
+	converter, from, code, ok, err := v.conversionRule(targetSchema.Format)
+	if err != nil {
+		errs = append(errs, newCompileError(fieldpath, targetSchema.Format, err))
+	}
+	if ok && from == current.Version {
+		if err := converter.ValidateConversion(fieldpath, code, current, target, currentSchema, targetSchema); err != nil {
+			errs = append(errs, newCompileError(fieldpath, code, err))
+		}
+	}
+	for propName, prop := range targetSchema.Properties {
+		currentProp := currentSchema.Properties[propName]
+		errs = append(errs, v.validateConversions(append(fieldpath, propName), current, target, &currentProp, &prop)...)
+	}
+	return errs
+}
+
+// validateConversionRules checks the conversion rules declared at the root of a
+// CustomResourceDefinition against the schemas of its versions, by name, compiling each rule. Returns
+// the rules that are invalid.
+func (v *formatValidators) validateConversionRules(versions map[string]validators.CRDVersion, conversions []validators.ConversionRules) []compileError {
+	var errs []compileError
+	converter, _ := v.converters[celConverterId].(validators.ObjectConverter)
+	pairs := map[[2]string]bool{}
+	for _, c := range conversions {
+		pairErr := func(err error) {
+			errs = append(errs, compileError{Version: c.FromVersion, TargetVersion: c.ToVersion, Path: "/", Error: err.Error()})
 		}
-		id := parts[0]
-		if !strings.HasPrefix(parts[1], "from=") {
-			return nil, fmt.Errorf("expected format of the form <id>:from=v1:<content>, but got %s", targetSchema.Format)
+		current, ok := versions[c.FromVersion]
+		if !ok {
+			pairErr(fmt.Errorf("converters: fromVersion %q is not a version with a schema", c.FromVersion))
+			continue
+		}
+		target, ok := versions[c.ToVersion]
+		if !ok {
+			pairErr(fmt.Errorf("converters: toVersion %q is not a version with a schema", c.ToVersion))
+			continue
+		}
+		if c.FromVersion == c.ToVersion {
+			pairErr(fmt.Errorf("converters: fromVersion and toVersion must differ"))
+			continue
 		}
-		from := strings.TrimPrefix(parts[1], "from=")
-		if from == currentVersion {
-			code := parts[2]
-			converter, ok := v.converters[id]
-			if ok {
-				return converter.Convert(fieldpath, code, currentVersion, targetVersion, currentSchema, targetSchema, obj)
+		pair := [2]string{c.FromVersion, c.ToVersion}
+		if pairs[pair] {
+			pairErr(fmt.Errorf("converters: duplicate converter"))
+			continue
+		}
+		pairs[pair] = true
+		fields := map[string]bool{}
+		for _, rule := range c.Rules {
+			ruleErr := func(err error) {
+				e := newCompileError(rule.Path(), rule.Rule, err)
+				e.Version, e.TargetVersion = c.FromVersion, c.ToVersion
+				errs = append(errs, e)
+			}
+			if err := validateFieldConversionRule(rule); err != nil {
+				ruleErr(err)
+				continue
+			}
+			if fields[rule.Field] {
+				ruleErr(fmt.Errorf("converters: duplicate rule for field %s", rule.Field))
+				continue
+			}
+			fields[rule.Field] = true
+			if converter != nil {
+				if err := converter.ValidateConversionRule(rule, current, target); err != nil {
+					ruleErr(err)
+				}
 			}
 		}
 	}
-	if len(targetSchema.Properties) > 0 {
-		if in, ok := obj.(map[string]interface{}); ok {
+	return errs
+}
+
+// convertObj converts obj, the value of the current schema node at fieldpath, to the target schema
+// node. A conversion rule from the current version declared in the format of the target node converts
+// the whole node. Otherwise the properties, map values and list items of obj are converted to those of
+// the target node, and scalars are copied if the types of the nodes are compatible, widening integers
+// to numbers and narrowing whole numbers to integers. Properties the target node does not declare are
+// dropped. mapped holds the full paths of the fields set by conversion rules declared at the root of the
+// CRD, which are not converted here, and values that cannot be converted to the target node are an error
+// unless they are under one of them.
+func (v *formatValidators) convertObj(ctx context.Context, fieldpath []string, current, target validators.CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, mapped map[string]bool, obj interface{}) (interface{}, error) {
+	converter, from, code, ok, err := v.conversionRule(targetSchema.Format)
+	if err != nil {
+		return nil, err
+	}
+	if ok && from == current.Version {
+		return convert(ctx, converter, fieldpath, code, current, target, currentSchema, targetSchema, obj)
+	}
+	switch in := obj.(type) {
+	case map[string]interface{}:
+		if len(targetSchema.Properties) > 0 {
+			propNames := make([]string, 0, len(targetSchema.Properties))
+			for propName := range targetSchema.Properties {
+				propNames = append(propNames, propName)
+			}
+			sort.Strings(propNames)
 			mout := map[string]interface{}{}
-			// TODO: walk both schema here
-			// TODO: only automatically convert things to the new schema when type and fieldname match
-			for propName, prop := range targetSchema.Properties {
+			for _, propName := range propNames {
+				value, ok := in[propName]
+				if !ok {
+					continue
+				}
+				propPath := append(append([]string{}, fieldpath...), propName)
+				if mapped[strings.Join(propPath, ".")] {
+					continue
+				}
+				prop := targetSchema.Properties[propName]
 				currentProp := currentSchema.Properties[propName]
-				if value, ok := in[propName]; ok {
-					out, err := v.convertObj(append(fieldpath, propName), currentVersion, targetVersion, &currentProp, &prop, value)
-					if err != nil {
-						return nil, err
-					}
-					mout[propName] = out
+				out, err := v.convertObj(ctx, propPath, current, target, &currentProp, &prop, mapped, value)
+				if err != nil {
+					return nil, err
+				}
+				mout[propName] = out
+			}
+			return mout, nil
+		}
+		if targetSchema.AdditionalProperties != nil && targetSchema.AdditionalProperties.Schema != nil {
+			currentValues := &apiextensionsv1.JSONSchemaProps{}
+			if currentSchema.AdditionalProperties != nil && currentSchema.AdditionalProperties.Schema != nil {
+				currentValues = currentSchema.AdditionalProperties.Schema
+			}
+			keys := make([]string, 0, len(in))
+			for key := range in {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			mout := map[string]interface{}{}
+			for _, key := range keys {
+				out, err := v.convertObj(ctx, append(fieldpath, "value"), current, target, currentValues, targetSchema.AdditionalProperties.Schema, mapped, in[key])
+				if err != nil {
+					return nil, err
 				}
+				mout[key] = out
 			}
 			return mout, nil
 		}
+	case []interface{}:
+		if targetSchema.Items != nil && targetSchema.Items.Schema != nil {
+			currentItems := &apiextensionsv1.JSONSchemaProps{}
+			if currentSchema.Items != nil && currentSchema.Items.Schema != nil {
+				currentItems = currentSchema.Items.Schema
+			}
+			lout := make([]interface{}, len(in))
+			for i, item := range in {
+				out, err := v.convertObj(ctx, append(fieldpath, "item"), current, target, currentItems, targetSchema.Items.Schema, mapped, item)
+				if err != nil {
+					return nil, err
+				}
+				lout[i] = out
+			}
+			return lout, nil
+		}
+	}
+	out, err := validators.ConvertValue(currentSchema, targetSchema, obj)
+	if err != nil {
+		return nil, fmt.Errorf("/%s: %w, declare a conversion rule for the field", strings.Join(fieldpath, "/"), err)
 	}
-	return obj, nil
+	return out, nil
 }
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	v1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/jpbetz/cel-webhook/validators"
+)
+
+// conversionTestCRD is a Widget CRD whose versions rename spec.a of v1 to spec.b of v2.
+var conversionTestCRD = widgetCRD(
+	[2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"},"num":{"type":"integer"}}}}}`},
+	[2]string{"v2", `{"type":"object","properties":{"spec":{"type":"object","properties":{"b":{"type":"string"},"num":{"type":"integer"}}}}}`},
+)
+
+func TestValidateRequestConversionRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		converters  string
+		expectedErr string
+	}{
+		{
+			name: "valid",
+			converters: `
+- fromVersion: v1
+  toVersion: v2
+  rules:
+  - field: spec.b
+    rule: "has(self.spec.a) ? self.spec.a : dyn(null)"`,
+		},
+		{
+			name:        "unknown fromVersion",
+			converters:  `[{"fromVersion":"v9","toVersion":"v2"}]`,
+			expectedErr: `fromVersion "v9" is not a version with a schema`,
+		},
+		{
+			name:        "unknown toVersion",
+			converters:  `[{"fromVersion":"v1","toVersion":"v9"}]`,
+			expectedErr: `toVersion "v9" is not a version with a schema`,
+		},
+		{
+			name:        "same versions",
+			converters:  `[{"fromVersion":"v1","toVersion":"v1"}]`,
+			expectedErr: "fromVersion and toVersion must differ",
+		},
+		{
+			name:        "duplicate converter",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2"},{"fromVersion":"v1","toVersion":"v2"}]`,
+			expectedErr: "duplicate converter",
+		},
+		{
+			name:        "empty rule",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec.b","rule":" "}]}]`,
+			expectedErr: "rule must not be empty",
+		},
+		{
+			name:        "empty path segment",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec..b","rule":"'x'"}]}]`,
+			expectedErr: "field must be a path of property names",
+		},
+		{
+			name:        "metadata",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"metadata.name","rule":"'x'"}]}]`,
+			expectedErr: "field metadata.name cannot be set by conversion rules",
+		},
+		{
+			name:        "duplicate field",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec.b","rule":"'x'"},{"field":"spec.b","rule":"'y'"}]}]`,
+			expectedErr: "duplicate rule for field spec.b",
+		},
+		{
+			name:        "field not declared by the target version",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec.a","rule":"'x'"}]}]`,
+			expectedErr: "from v1 to v2",
+		},
+		{
+			name:        "wrong type",
+			converters:  `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec.num","rule":"'x'"}]}]`,
+			expectedErr: "from v1 to v2",
+		},
+		{
+			name:        "invalid annotation",
+			converters:  `{"fromVersion":"v1"}`,
+			expectedErr: convertersAnnotation,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestValidators(t)
+			resp := v.validateRequest(context.Background(), crdReview(t, withConverters(t, conversionTestCRD, tc.converters)))
+			if tc.expectedErr == "" {
+				if !resp.Allowed {
+					t.Fatalf("expected CRD to be allowed, got %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed || resp.Result == nil || !strings.Contains(resp.Result.Message, tc.expectedErr) {
+				t.Errorf("expected failure containing %q, got %v", tc.expectedErr, resp.Result)
+			}
+		})
+	}
+}
+
+func TestConvertRequestConversionRules(t *testing.T) {
+	v := newTestValidators(t, withConverters(t, conversionTestCRD, `
+- fromVersion: v1
+  toVersion: v2
+  rules:
+  - field: spec.b
+    rule: "has(self.spec.a) ? self.spec.a : dyn(null)"
+- fromVersion: v2
+  toVersion: v1
+  rules:
+  - field: spec.a
+    rule: "has(self.spec.b) ? self.spec.b : dyn(null)"`))
+	ctx := context.Background()
+
+	converted := convertedObjects(t, v.convertRequest(ctx, conversionReview(t, "example.com/v2",
+		widget(t, "v1", `{"a":"x","num":1}`),
+		widget(t, "v1", `{"num":2}`),
+	)))
+	expected := []map[string]interface{}{widget(t, "v2", `{"b":"x","num":1}`), widget(t, "v2", `{"num":2}`)}
+	if !reflect.DeepEqual(converted, expected) {
+		t.Errorf("expected %v, got %v", expected, converted)
+	}
+
+	converted = convertedObjects(t, v.convertRequest(ctx, conversionReview(t, "example.com/v1", widget(t, "v2", `{"b":"y"}`))))
+	expected = []map[string]interface{}{widget(t, "v1", `{"a":"y"}`)}
+	if !reflect.DeepEqual(converted, expected) {
+		t.Errorf("expected %v, got %v", expected, converted)
+	}
+}
+
+func TestConvertRequestCrontabExample(t *testing.T) {
+	v := newTestValidators(t, crontabCRD(t))
+	obj := map[string]interface{}{
+		"apiVersion": "stable.example.com/v1",
+		"kind":       "CronTab",
+		"metadata":   map[string]interface{}{"name": "c", "namespace": "default"},
+		"spec":       map[string]interface{}{"cronSpec": "*/5 * * * *", "image": "img", "replicas": int64(1)},
+	}
+	converted := convertedObjects(t, v.convertRequest(context.Background(), conversionReview(t, "stable.example.com/v2", obj)))
+	spec := converted[0]["spec"].(map[string]interface{})
+	if spec["image2"] != "img" || spec["image"] != nil {
+		t.Errorf("expected image to be converted to image2, got %v", spec)
+	}
+}
+
+func TestValidateRequestCrontabExample(t *testing.T) {
+	v := newTestValidators(t, crontabCRD(t))
+	for _, tc := range []struct {
+		file    string
+		allowed bool
+	}{
+		{file: "example/crontab/valid.yaml", allowed: true},
+		{file: "example/crontab/invalid.yaml", allowed: false},
+	} {
+		obj, err := loadObject(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, obj.Object, nil))
+		if resp.Allowed != tc.allowed {
+			t.Errorf("%s: expected allowed to be %t, got %v", tc.file, tc.allowed, resp.Result)
+		}
+	}
+
+	obj := map[string]interface{}{
+		"apiVersion": "stable.example.com/v1",
+		"kind":       "CronTab",
+		"metadata":   map[string]interface{}{"name": "c", "namespace": "default"},
+		"spec":       map[string]interface{}{"cronSpec": "*/5 * * * *", "image": "img", "minReplicas": int64(1), "replicas": int64(6)},
+	}
+	if resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, obj, nil)); !resp.Allowed {
+		t.Errorf("expected a CronTab without maxReplicas to be allowed, got %v", resp.Result)
+	}
+}
+
+func TestCrontabExampleRulesSurvivePersistence(t *testing.T) {
+	raw, err := yaml.YAMLToJSON([]byte(crontabCRD(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Round trip the CRD through the typed API, as the apiserver does when persisting it, which drops
+	// the vendor extensions the API does not model.
+	typed := &apiextensionsv1.CustomResourceDefinition{}
+	if err := json.Unmarshal(raw, typed); err != nil {
+		t.Fatal(err)
+	}
+	persisted, err := json.Marshal(typed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newTestValidators(t, string(persisted))
+
+	obj := map[string]interface{}{
+		"apiVersion": "stable.example.com/v1",
+		"kind":       "CronTab",
+		"metadata":   map[string]interface{}{"name": "c", "namespace": "default"},
+		"spec":       map[string]interface{}{"cronSpec": "*/5 * * * *", "image": "img", "minReplicas": int64(1), "replicas": int64(6), "maxReplicas": int64(5)},
+	}
+	resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, obj, nil))
+	if resp.Allowed || !strings.Contains(resp.Result.Message, "replicas must be less than or equal to 5") {
+		t.Errorf("expected the replicas rules to be evaluated, got %v", resp.Result)
+	}
+	converted := convertedObjects(t, v.convertRequest(context.Background(), conversionReview(t, "stable.example.com/v2", obj)))
+	if spec := converted[0]["spec"].(map[string]interface{}); spec["image2"] != "img" {
+		t.Errorf("expected the conversion rules to be evaluated, got %v", spec)
+	}
+	obj["spec"] = map[string]interface{}{"cronSpec": "*/5 * * * *", "image": "img", "maxReplicas": int64(5)}
+	resp = v.mutateRequest(context.Background(), admissionReview(t, v1.Create, obj, nil))
+	expected := `[{"op":"add","path":"/spec/minReplicas","value":1},{"op":"add","path":"/spec/replicas","value":1}]`
+	if !resp.Allowed || string(resp.Patch) != expected {
+		t.Errorf("expected the defaults to be applied with patch %s, got %s (%v)", expected, resp.Patch, resp.Result)
+	}
+}
+
+func TestRegisterCustomResourceDefinitionResync(t *testing.T) {
+	crd := withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object"}}}`}),
+		`[{"version":"v1","field":"spec","validations":[{"rule":"1 + 'a'"}]}]`)
+	v := newFormatValidators()
+	v.registerFormat(celValidatorId, validators.NewCelValidator())
+	registerTestCRD(t, v, crd)
+	status, _ := v.statuses.get("widgets.example.com")
+	if len(status.CompileErrors) != 1 {
+		t.Fatalf("expected a compile error, got %v", status.CompileErrors)
+	}
+
+	registerTestCRD(t, v, crd)
+	if resynced, _ := v.statuses.get("widgets.example.com"); resynced != status {
+		t.Errorf("expected an unchanged CRD not to be compiled again")
+	}
+
+	registerTestCRD(t, v, strings.Replace(crd, `"generation":1`, `"generation":2`, 1))
+	updated, _ := v.statuses.get("widgets.example.com")
+	if updated == status || updated.Generation != 2 {
+		t.Errorf("expected a new generation to be compiled, got %+v", updated)
+	}
+
+	registerTestCRD(t, v, withConverters(t, strings.Replace(crd, `"generation":1`, `"generation":2`, 1), `[]`))
+	annotated, _ := v.statuses.get("widgets.example.com")
+	if annotated == updated {
+		t.Errorf("expected changed conversion rules to be compiled")
+	}
+
+	registerTestCRD(t, v, withRules(t, withConverters(t, strings.Replace(crd, `"generation":1`, `"generation":2`, 1), `[]`), `[]`))
+	if ruleless, _ := v.statuses.get("widgets.example.com"); ruleless == annotated || len(ruleless.CompileErrors) != 0 {
+		t.Errorf("expected changed validation rules to be compiled, got %+v", ruleless)
+	}
+
+	v.UnregisterCustomResourceDefinition(&apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: "widgets.example.com"}})
+	registerTestCRD(t, v, crd)
+	if recreated, _ := v.statuses.get("widgets.example.com"); recreated == nil || recreated.Generation != 1 {
+		t.Errorf("expected an unregistered CRD to be compiled again, got %+v", recreated)
+	}
+}
+
+// validateTest is a Widget validated by the rules of its schema.
+type validateTest struct {
+	name    string
+	spec    string
+	oldSpec string
+	// expected holds each expected cause of the failure, in order, as its field, ": ", and a substring
+	// of its message. The Widget is expected to be allowed if there are none.
+	expected []string
+}
+
+// testValidateRequests validates the Widgets of tests against a Widget CRD with specSchema, the JSON
+// encoded schema of spec, and with the validation rules rules. Widgets with an oldSpec are validated
+// as updates.
+func testValidateRequests(t *testing.T, specSchema, rules string, tests []validateTest) {
+	t.Helper()
+	v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":` + specSchema + `}}`}), rules))
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ar := admissionReview(t, v1.Create, widget(t, "v1", tc.spec), nil)
+			if tc.oldSpec != "" {
+				ar = admissionReview(t, v1.Update, widget(t, "v1", tc.spec), widget(t, "v1", tc.oldSpec))
+			}
+			resp := v.validateRequest(context.Background(), ar)
+			if len(tc.expected) == 0 {
+				if !resp.Allowed {
+					t.Errorf("expected to be allowed, got %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed || resp.Result == nil || resp.Result.Details == nil {
+				t.Fatalf("expected to be rejected with %v, got %v", tc.expected, resp.Result)
+			}
+			var causes []string
+			for _, c := range resp.Result.Details.Causes {
+				causes = append(causes, c.Field+": "+c.Message)
+			}
+			if len(causes) != len(tc.expected) {
+				t.Fatalf("expected causes %q, got %q", tc.expected, causes)
+			}
+			for i, expected := range tc.expected {
+				field := strings.SplitN(expected, ": ", 2)
+				if !strings.HasPrefix(causes[i], field[0]+": ") || !strings.Contains(causes[i], field[1]) {
+					t.Errorf("expected cause %q, got %q", expected, causes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRequestSelfAndRoot(t *testing.T) {
+	testValidateRequests(t, `{"type":"object","properties":{
+			"min":{"type":"integer"},
+			"max":{"type":"integer"},
+			"ports":{"type":"array","maxItems":10,"items":{"type":"object","properties":{"port":{"type":"integer"}}}},
+			"limits":{"type":"object","maxProperties":10,"additionalProperties":{"type":"integer"}}}}`, `
+- {version: v1, field: spec, validations: [{rule: "self.min <= max"}]}
+- {version: v1, field: "spec.ports[*]", validations: [{rule: "self.port >= root.spec.min"}]}
+- {version: v1, field: "spec.ports[*].port", validations: [{rule: "self <= root.spec.max"}]}
+- {version: v1, field: "spec.limits[*]", validations: [{rule: "self <= root.spec.max"}]}`,
+		[]validateTest{
+			{
+				name: "valid",
+				spec: `{"min":1,"max":10,"ports":[{"port":1},{"port":10}],"limits":{"a":10}}`,
+			},
+			{
+				name:     "object rule with property variables",
+				spec:     `{"min":2,"max":1}`,
+				expected: []string{"spec: failed validation rule"},
+			},
+			{
+				name:     "list item rules bound to the item and the root",
+				spec:     `{"min":2,"max":10,"ports":[{"port":2},{"port":1},{"port":11}]}`,
+				expected: []string{"spec.ports[1]: failed validation rule", "spec.ports[2].port: failed validation rule"},
+			},
+			{
+				name:     "map value rules bound to the value and the root",
+				spec:     `{"min":1,"max":10,"limits":{"a":1,"b":11}}`,
+				expected: []string{"spec.limits[b]: failed validation rule"},
+			},
+		})
+}
+
+func TestValidateRequestTransitionRules(t *testing.T) {
+	testValidateRequests(t, `{"type":"object","properties":{
+			"name":{"type":"string"},
+			"replicas":{"type":"integer"},
+			"ports":{"type":"array","maxItems":10,"x-kubernetes-list-type":"map","x-kubernetes-list-map-keys":["name"],
+				"items":{"type":"object","properties":{
+					"name":{"type":"string"},
+					"port":{"type":"integer"}}}}}}`, `
+- {version: v1, field: spec.name, validations: [{rule: "self == oldSelf", message: "name is immutable"}]}
+- {version: v1, field: spec.replicas, validations: [{rule: "self >= oldSelf", message: "replicas may not decrease"}]}
+- {version: v1, field: "spec.ports[*].port", validations: [{rule: "self == oldSelf", message: "port is immutable"}]}`,
+		[]validateTest{
+			{
+				name: "transition rules are skipped on create",
+				spec: `{"name":"a","replicas":1,"ports":[{"name":"http","port":80}]}`,
+			},
+			{
+				name:    "unchanged",
+				spec:    `{"name":"a","replicas":1,"ports":[{"name":"http","port":80}]}`,
+				oldSpec: `{"name":"a","replicas":1,"ports":[{"name":"http","port":80}]}`,
+			},
+			{
+				name:     "changed",
+				spec:     `{"name":"b","replicas":1}`,
+				oldSpec:  `{"name":"a","replicas":2}`,
+				expected: []string{"spec.name: name is immutable", "spec.replicas: replicas may not decrease"},
+			},
+			{
+				name:    "fields absent from the old object are skipped",
+				spec:    `{"name":"a","replicas":1}`,
+				oldSpec: `{}`,
+			},
+			{
+				name:     "list map items are correlated by key",
+				spec:     `{"ports":[{"name":"https","port":443},{"name":"http","port":8080}]}`,
+				oldSpec:  `{"ports":[{"name":"http","port":80}]}`,
+				expected: []string{"spec.ports[1].port: port is immutable"},
+			},
+		})
+}
+
+func TestValidateRequestRulesAnnotation(t *testing.T) {
+	testValidateRequests(t, `{"type":"object","properties":{
+			"a":{"type":"integer","format":"validation: self > 0"},
+			"t":{"type":"string","format":"date-time"}}}`,
+		`[{"version":"v1","field":"spec.a","validations":[{"rule":"self < 10"},{"rule":"self != 5"}]}]`,
+		[]validateTest{
+			{
+				name: "valid",
+				spec: `{"a":1,"t":"2021-01-01T00:00:00Z"}`,
+			},
+			{
+				name:     "legacy format rule",
+				spec:     `{"a":0}`,
+				expected: []string{"spec.a: failed validation rule"},
+			},
+			{
+				name:     "every rule of the annotation",
+				spec:     `{"a":5}`,
+				expected: []string{"spec.a: failed validation rule"},
+			},
+		})
+}
+
+func TestValidateRequestLegacyFormatRulesDisabled(t *testing.T) {
+	v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{
+		"a":{"type":"integer","format":"validation: self > 0"}}}}}`}), `[{"version":"v1","field":"spec.a","validations":[{"rule":"self < 10"}]}]`))
+	v.legacyFormatRules = false
+	if resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, widget(t, "v1", `{"a":0}`), nil)); !resp.Allowed {
+		t.Errorf("expected legacy format rules to be ignored, got %v", resp.Result)
+	}
+	if resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, widget(t, "v1", `{"a":10}`), nil)); resp.Allowed {
+		t.Errorf("expected the rules of the rules annotation to be evaluated")
+	}
+}
+
+func TestValidateRequestInvalidRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		validations string
+		expectedErr string
+	}{
+		{name: "valid", validations: `[{"rule":"self > 0","message":"m","reason":"FieldValueForbidden","fieldPath":".x"}]`},
+		{name: "empty rule", validations: `[{"rule":" "}]`, expectedErr: "rule must not be empty"},
+		{name: "unsupported reason", validations: `[{"rule":"true","reason":"Bad"}]`, expectedErr: `unsupported reason "Bad"`},
+		{name: "relative fieldPath", validations: `[{"rule":"true","fieldPath":"x"}]`, expectedErr: "fieldPath must be a path relative to the schema node"},
+		{name: "type error", validations: `[{"rule":"self > 'a'"}]`, expectedErr: "invalid rules in version v1"},
+		{name: "not a boolean", validations: `[{"rule":"self"}]`, expectedErr: "invalid rules in version v1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestValidators(t)
+			crd := withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"integer"}}}}}`}),
+				`[{"version":"v1","field":"spec.a","validations":`+tc.validations+`}]`)
+			resp := v.validateRequest(context.Background(), crdReview(t, crd))
+			if tc.expectedErr == "" {
+				if !resp.Allowed {
+					t.Errorf("expected CRD to be allowed, got %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed || resp.Result == nil || !strings.Contains(resp.Result.Message, tc.expectedErr) {
+				t.Errorf("expected failure containing %q, got %v", tc.expectedErr, resp.Result)
+			}
+		})
+	}
+}
+
+func TestValidateRequestInvalidRulesAnnotation(t *testing.T) {
+	crd := widgetCRD(
+		[2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{
+			"a":{"type":"integer"},
+			"ports":{"type":"array","items":{"type":"object","properties":{"port":{"type":"integer"}}}},
+			"limits":{"type":"object","additionalProperties":{"type":"integer"}}}}}}`},
+		[2]string{"v2", `{"type":"object","properties":{"spec":{"type":"object"}}}`},
+	)
+	tests := []struct {
+		name        string
+		rules       string
+		expectedErr string
+	}{
+		{
+			name: "valid",
+			rules: `
+- {version: v1, validations: [{rule: "has(self.spec)"}]}
+- {version: v1, field: "spec.ports[*].port", validations: [{rule: "self > 0"}]}
+- {version: v1, field: "spec.limits[*]", validations: [{rule: "self > 0"}]}
+- {version: v1, field: spec.a, default: {rule: "size(self.ports)"}}
+- {version: v2, field: spec, validations: [{rule: "self == self"}]}`,
+		},
+		{name: "unknown version", rules: `[{"version":"v9","field":"spec"}]`, expectedErr: `version v9: /spec: rules: version "v9" is not a version with a schema`},
+		{name: "undeclared property", rules: `[{"version":"v2","field":"spec.a"}]`, expectedErr: `version v2: /spec/a: rules: property "a" is not declared by the schema`},
+		{name: "items of a property that is not a list", rules: `[{"version":"v1","field":"spec.a[*]"}]`, expectedErr: "[*] must follow an array or a map"},
+		{name: "empty path segment", rules: `[{"version":"v1","field":"spec..a"}]`, expectedErr: "field must be a path of property names"},
+		{name: "duplicate field", rules: `[{"version":"v1","field":"spec"},{"version":"v1","field":"spec"}]`, expectedErr: `duplicate entry for field "spec"`},
+		{name: "invalid rule", rules: `[{"version":"v1","field":"spec.a","validations":[{"rule":"self > 'a'"}]}]`, expectedErr: "invalid rules in version v1"},
+		{name: "default of the root", rules: `[{"version":"v1","default":{"value":{}}}]`, expectedErr: "default must be set on a property"},
+		{name: "default of list items", rules: `[{"version":"v1","field":"spec.ports[*]","default":{"value":{}}}]`, expectedErr: "default must be set on a property"},
+		{name: "default with value and rule", rules: `[{"version":"v1","field":"spec.a","default":{"value":1,"rule":"1"}}]`, expectedErr: "exactly one of value or rule"},
+		{name: "default value of the wrong type", rules: `[{"version":"v1","field":"spec.a","default":{"value":"x"}}]`, expectedErr: "invalid default value"},
+		{name: "default rule of the wrong type", rules: `[{"version":"v1","field":"spec.a","default":{"rule":"'x'"}}]`, expectedErr: "invalid rules in version v1"},
+		{name: "invalid annotation", rules: `{"version":"v1"}`, expectedErr: rulesAnnotation},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestValidators(t)
+			resp := v.validateRequest(context.Background(), crdReview(t, withRules(t, crd, tc.rules)))
+			if tc.expectedErr == "" {
+				if !resp.Allowed {
+					t.Errorf("expected CRD to be allowed, got %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed || resp.Result == nil || !strings.Contains(resp.Result.Message, tc.expectedErr) {
+				t.Errorf("expected failure containing %q, got %v", tc.expectedErr, resp.Result)
+			}
+		})
+	}
+}
+
+func TestValidateRequestAggregatesFailures(t *testing.T) {
+	testValidateRequests(t, `{"type":"object","properties":{
+			"min":{"type":"integer"},
+			"max":{"type":"integer"},
+			"ports":{"type":"array","maxItems":10,"items":{"type":"object","properties":{"port":{"type":"integer"}}}},
+			"limits":{"type":"object","maxProperties":10,"additionalProperties":{"type":"integer"}}}}`, `
+- version: v1
+  field: spec
+  validations:
+  - {rule: "self.min <= self.max", fieldPath: .min}
+  - {rule: "self.min >= 0", reason: FieldValueForbidden}
+- {version: v1, field: "spec.ports[*]", validations: [{rule: "self.port > 0", reason: FieldValueRequired}]}
+- {version: v1, field: "spec.limits[*]", validations: [{rule: "self > 0", reason: FieldValueDuplicate}]}`,
+		[]validateTest{
+			{
+				name: "valid",
+				spec: `{"min":0,"max":1,"ports":[{"port":1}],"limits":{"a":1}}`,
+			},
+			{
+				name: "every failure in order",
+				spec: `{"min":-1,"max":-2,"ports":[{"port":1},{"port":0},{"port":-1}],"limits":{"b":0,"a":0}}`,
+				expected: []string{
+					"spec.min: Invalid value",
+					"spec: Forbidden",
+					"spec.limits[a]: Duplicate value",
+					"spec.limits[b]: Duplicate value",
+					"spec.ports[1]: Required",
+					"spec.ports[2]: Required",
+				},
+			},
+		})
+}
+
+func TestValidateRequestMessages(t *testing.T) {
+	testValidateRequests(t, `{"type":"object","properties":{
+			"max":{"type":"integer"},
+			"static":{"type":"integer"},
+			"expression":{"type":"integer"},
+			"empty":{"type":"integer"},
+			"failing":{"type":"integer"},
+			"none":{"type":"integer"}}}`, `[
+			{"version":"v1","field":"spec.static","validations":[{"rule":"self <= root.spec.max","message":"static must be <= max"}]},
+			{"version":"v1","field":"spec.expression","validations":[{"rule":"self <= root.spec.max","message":"unused","messageExpression":"'expression must be <= ' + string(root.spec.max)"}]},
+			{"version":"v1","field":"spec.empty","validations":[{"rule":"self <= root.spec.max","message":"empty must be <= max","messageExpression":"' '"}]},
+			{"version":"v1","field":"spec.failing","validations":[{"rule":"self <= root.spec.max","message":"failing must be <= max","messageExpression":"string(1 / (self - self))"}]},
+			{"version":"v1","field":"spec.none","validations":[{"rule":"self <= root.spec.max"}]}]`,
+		[]validateTest{
+			{
+				name: "valid",
+				spec: `{"max":1,"static":1,"expression":1,"empty":1,"failing":1,"none":1}`,
+			},
+			{
+				name: "messages",
+				spec: `{"max":1,"static":2,"expression":2,"empty":2,"failing":2,"none":2}`,
+				expected: []string{
+					"spec.empty: empty must be <= max",
+					"spec.expression: expression must be <= 1",
+					"spec.failing: failing must be <= max",
+					"spec.none: failed validation rule",
+					"spec.static: static must be <= max",
+				},
+			},
+		})
+}
+
+func TestValidateRequestInvalidMessageExpression(t *testing.T) {
+	v := newTestValidators(t)
+	for _, messageExpression := range []string{"self", "self.missing"} {
+		crd := withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"integer"}}}}}`}),
+			`[{"version":"v1","field":"spec.a","validations":[{"rule":"self > 0","messageExpression":"`+messageExpression+`"}]}]`)
+		resp := v.validateRequest(context.Background(), crdReview(t, crd))
+		if resp.Allowed || !strings.Contains(resp.Result.Message, "messageExpression") {
+			t.Errorf("%s: expected CRD to be rejected, got %v", messageExpression, resp.Result)
+		}
+	}
+}
+
+func TestValidateRequestRuntimeCostBudget(t *testing.T) {
+	v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{
+		"a":{"type":"array","maxItems":20,"items":{"type":"string","maxLength":1}},
+		"b":{"type":"array","maxItems":20,"items":{"type":"string","maxLength":1}}}}}}`}),
+		`[{"version":"v1","field":"spec.a","validations":[{"rule":"self.all(x, x == 'a')"}]},{"version":"v1","field":"spec.b","validations":[{"rule":"self.all(x, x == 'b')"}]}]`))
+	// Each rule fits within the limit for 11 items on its own, but not both.
+	v.validators[celValidatorId].(*validators.CelValidator).RuntimeCostLimit = 50
+	items := func(item string) string {
+		return `["` + strings.Repeat(item+`","`, 10) + item + `"]`
+	}
+
+	for _, spec := range []string{`{"a":` + items("a") + `}`, `{"b":` + items("b") + `}`} {
+		if resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, widget(t, "v1", spec), nil)); !resp.Allowed {
+			t.Errorf("expected each request to have its own budget, got %v", resp.Result)
+		}
+	}
+	spec := `{"a":` + items("a") + `,"b":` + items("b") + `}`
+	resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, widget(t, "v1", spec), nil))
+	if resp.Allowed || !strings.Contains(resp.Result.Message, "evaluation cost exceeded the limit of 50") {
+		t.Errorf("expected the rules of a request to share the budget, got %v", resp.Result)
+	}
+}
+
+func TestValidateRequestRuntimeCostBudgetExceeded(t *testing.T) {
+	v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{
+		"a":{"type":"array","maxItems":20,"items":{"type":"string","maxLength":1}},
+		"b":{"type":"string"},
+		"c":{"type":"string"}}}}}`}),
+		`[{"version":"v1","field":"spec.a","validations":[{"rule":"self.all(x, self.all(y, x == y))"}]},{"version":"v1","field":"spec.b","validations":[{"rule":"self == 'b'"}]},{"version":"v1","field":"spec.c","validations":[{"rule":"self == 'c'"}]}]`))
+	v.validators[celValidatorId].(*validators.CelValidator).RuntimeCostLimit = 50
+	spec := `{"a":["a","a","a","a","a","a","a","a","a","a","a"],"b":"b","c":"c"}`
+
+	resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, widget(t, "v1", spec), nil))
+	if resp.Allowed || resp.Result.Code != http.StatusForbidden || resp.Result.Reason != metav1.StatusReasonForbidden {
+		t.Fatalf("expected the request to be forbidden, got %v", resp.Result)
+	}
+	if strings.Count(resp.Result.Message, "evaluation cost exceeded the limit of 50") != 1 {
+		t.Errorf("expected a single error naming the limit, got %q", resp.Result.Message)
+	}
+	if resp.Result.Details != nil && len(resp.Result.Details.Causes) > 1 {
+		t.Errorf("expected at most one cause, got %v", resp.Result.Details.Causes)
+	}
+}
+
+func TestRequestsWithExpiredDeadline(t *testing.T) {
+	v := newTestValidators(t, withRules(t, withConverters(t, widgetCRD(
+		[2]string{"v1", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"integer"}}}}}`},
+		[2]string{"v2", `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"integer"}}}}}`},
+	), `[{"fromVersion":"v1","toVersion":"v2","rules":[{"field":"spec.a","rule":"self.spec.a + 1"}]}]`),
+		`[{"version":"v1","field":"spec","validations":[{"rule":"self.a > 0"}]},{"version":"v1","field":"spec.a","default":{"rule":"1"}}]`))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	obj := widget(t, "v1", `{}`)
+
+	if resp := v.validateRequest(ctx, admissionReview(t, v1.Create, obj, nil)); resp.Allowed || resp.Result.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected validation to time out, got %v", resp.Result)
+	}
+	if resp := v.mutateRequest(ctx, admissionReview(t, v1.Create, obj, nil)); resp.Allowed || resp.Result.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected mutation to time out, got %v", resp.Result)
+	}
+	if resp := v.convertRequest(ctx, conversionReview(t, "example.com/v2", widget(t, "v1", `{"a":1}`))); resp.Result.Status != metav1.StatusFailure {
+		t.Errorf("expected conversion to fail, got %v", resp.Result)
+	}
+}
+
+func TestConvertRequestFailures(t *testing.T) {
+	v := newTestValidators(t, conversionTestCRD)
+	ctx := context.Background()
+	named := func(obj map[string]interface{}, name string) map[string]interface{} {
+		obj["metadata"].(map[string]interface{})["name"] = name
+		return obj
+	}
+
+	resp := v.convertRequest(ctx, conversionReview(t, "example.com/v2", named(widget(t, "v1", `{"num":1}`), "a"), named(widget(t, "v2", `{"num":2}`), "b")))
+	if converted := convertedObjects(t, resp); len(converted) != 2 {
+		t.Errorf("expected every object to be converted, got %v", converted)
+	}
+
+	resp = v.convertRequest(ctx, conversionReview(t, "example.com/v2",
+		named(widget(t, "v1", `{"num":1}`), "a"),
+		named(widget(t, "v9", `{}`), "b"),
+		named(widget(t, "v1", `{"num":"x"}`), "c"),
+	))
+	if resp.Result.Status != metav1.StatusFailure || len(resp.ConvertedObjects) != 0 {
+		t.Fatalf("expected the review to fail without converted objects, got %v", resp)
+	}
+	for _, expected := range []string{
+		"failed to convert 2 of 3 objects to example.com/v2",
+		"Widget default/b: no CRD with a schema for example.com/v9, Kind=Widget is registered",
+		"Widget default/c: ",
+	} {
+		if !strings.Contains(resp.Result.Message, expected) {
+			t.Errorf("expected message containing %q, got %q", expected, resp.Result.Message)
+		}
+	}
+	if strings.Contains(resp.Result.Message, "default/a") {
+		t.Errorf("expected converted objects not to be reported, got %q", resp.Result.Message)
+	}
+
+	review := conversionReview(t, "example.com/v2")
+	review.Request.Objects = append(review.Request.Objects, runtime.RawExtension{Raw: []byte(`{`)})
+	if resp := v.convertRequest(ctx, review); resp.Result.Status != metav1.StatusFailure || !strings.Contains(resp.Result.Message, "object 0: ") {
+		t.Errorf("expected undecodable objects to fail the review, got %v", resp.Result)
+	}
+}
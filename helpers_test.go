@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	v1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/jpbetz/cel-webhook/validators"
+)
+
+// newTestValidators returns formatValidators with the CEL validator registered for all rules, and with
+// crds, JSON or YAML encoded CustomResourceDefinitions, registered. Fails the test if any of their rules
+// fails to compile.
+func newTestValidators(t *testing.T, crds ...string) *formatValidators {
+	t.Helper()
+	v := newFormatValidators()
+	celValidator := validators.NewCelValidator()
+	v.registerFormat(celValidatorId, celValidator)
+	v.registerConverter(celConverterId, celValidator)
+	v.registerDefaulter(celDefaulterId, celValidator)
+	for _, crd := range crds {
+		registerTestCRD(t, v, crd)
+	}
+	for _, status := range v.statuses.list() {
+		if len(status.CompileErrors) > 0 {
+			t.Fatalf("unexpected compile errors for %s: %v", status.Name, status.CompileErrors)
+		}
+	}
+	return v
+}
+
+// registerTestCRD registers crd, a JSON or YAML encoded CustomResourceDefinition.
+func registerTestCRD(t *testing.T, v *formatValidators, crd string) {
+	t.Helper()
+	raw, err := yaml.YAMLToJSON([]byte(crd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &apiextensionsv1.CustomResourceDefinition{}
+	if err := json.Unmarshal(raw, o); err != nil {
+		t.Fatal(err)
+	}
+	v.RegisterCustomResourceDefinition(o)
+}
+
+// crontabCRD returns the example CronTab CustomResourceDefinition.
+func crontabCRD(t *testing.T) string {
+	t.Helper()
+	b, err := os.ReadFile("example/crontab/crd-template.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ReplaceAll(string(b), "CA_BUNDLE", "Q0FfQlVORExF")
+}
+
+// widgetCRD returns a JSON encoded CustomResourceDefinition of kind Widget in group example.com, with a
+// version for each pair of name and JSON encoded openAPIV3Schema. The first version is stored.
+func widgetCRD(versions ...[2]string) string {
+	crd := map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata":   map[string]interface{}{"name": "widgets.example.com", "uid": "widgets-uid", "generation": 1},
+	}
+	var vs []interface{}
+	for i, version := range versions {
+		vs = append(vs, map[string]interface{}{
+			"name":    version[0],
+			"served":  true,
+			"storage": i == 0,
+			"schema":  map[string]interface{}{"openAPIV3Schema": json.RawMessage(version[1])},
+		})
+	}
+	crd["spec"] = map[string]interface{}{
+		"group":    "example.com",
+		"names":    map[string]interface{}{"kind": "Widget", "plural": "widgets"},
+		"scope":    "Namespaced",
+		"versions": vs,
+	}
+	b, err := json.Marshal(crd)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// withConverters returns crd, a JSON encoded CustomResourceDefinition, with the conversion rules
+// converters, given as YAML or JSON.
+func withConverters(t *testing.T, crd, converters string) string {
+	t.Helper()
+	return withAnnotation(t, crd, convertersAnnotation, converters)
+}
+
+// withRules returns crd, a JSON encoded CustomResourceDefinition, with the validation rules rules,
+// given as YAML or JSON.
+func withRules(t *testing.T, crd, rules string) string {
+	t.Helper()
+	return withAnnotation(t, crd, rulesAnnotation, rules)
+}
+
+// withAnnotation returns crd, a JSON encoded CustomResourceDefinition, with the annotation key set to
+// value.
+func withAnnotation(t *testing.T, crd, key, value string) string {
+	t.Helper()
+	o := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(crd), &o); err != nil {
+		t.Fatal(err)
+	}
+	metadata := o["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+	}
+	annotations[key] = value
+	metadata["annotations"] = annotations
+	b, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// widget returns a Widget at version with spec, given as JSON.
+func widget(t *testing.T, version, spec string) map[string]interface{} {
+	t.Helper()
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{"apiVersion":"example.com/`+version+`","kind":"Widget","metadata":{"name":"w","namespace":"default"},"spec":`+spec+`}`), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// admissionReview returns an AdmissionReview of an operation on obj, replacing old if it is not nil.
+func admissionReview(t *testing.T, op v1.Operation, obj, old map[string]interface{}) v1.AdmissionReview {
+	t.Helper()
+	ar := v1.AdmissionReview{Request: &v1.AdmissionRequest{UID: "review-uid", Operation: op}}
+	var err error
+	if ar.Request.Object.Raw, err = json.Marshal(obj); err != nil {
+		t.Fatal(err)
+	}
+	if old != nil {
+		ar.Request.OldObject = runtime.RawExtension{}
+		if ar.Request.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ar
+}
+
+// crdReview returns an AdmissionReview of the creation of crd, a JSON or YAML encoded
+// CustomResourceDefinition.
+func crdReview(t *testing.T, crd string) v1.AdmissionReview {
+	t.Helper()
+	raw, err := yaml.YAMLToJSON([]byte(crd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		UID:       "review-uid",
+		Kind:      metav1.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"},
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+// conversionReview returns a ConversionReview of objs to desiredAPIVersion.
+func conversionReview(t *testing.T, desiredAPIVersion string, objs ...map[string]interface{}) apiextensionsv1.ConversionReview {
+	t.Helper()
+	review := apiextensionsv1.ConversionReview{Request: &apiextensionsv1.ConversionRequest{UID: "review-uid", DesiredAPIVersion: desiredAPIVersion}}
+	for _, obj := range objs {
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		review.Request.Objects = append(review.Request.Objects, runtime.RawExtension{Raw: raw})
+	}
+	return review
+}
+
+// convertedObjects returns the objects converted by resp, failing the test if the conversion failed.
+func convertedObjects(t *testing.T, resp *apiextensionsv1.ConversionResponse) []map[string]interface{} {
+	t.Helper()
+	if resp.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("expected conversion to succeed, got %s", resp.Result.Message)
+	}
+	var objs []map[string]interface{}
+	for _, converted := range resp.ConvertedObjects {
+		raw, err := json.Marshal(converted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+	return objs
+}
@@ -5,15 +5,17 @@ import (
 	"time"
 
 	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	"k8s.io/apimachinery/pkg/util/runtime"
 	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// Registry is notified of CustomResourceDefinitions as they are added, updated and deleted.
 type Registry interface {
 	RegisterCustomResourceDefinition(crd *v1.CustomResourceDefinition)
+	UnregisterCustomResourceDefinition(crd *v1.CustomResourceDefinition)
 }
 
 func StartCRDInformer(registry Registry, stopCh chan struct{}) error {
@@ -39,7 +41,7 @@ func StartCRDInformer(registry Registry, stopCh chan struct{}) error {
 	// event that the shared informer catches
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		// When a new pod gets created
-		AddFunc:    func(obj interface{}) {
+		AddFunc: func(obj interface{}) {
 			if crd, ok := obj.(*v1.CustomResourceDefinition); ok {
 				registry.RegisterCustomResourceDefinition(crd)
 			}
@@ -51,11 +53,16 @@ func StartCRDInformer(registry Registry, stopCh chan struct{}) error {
 			}
 		},
 		// When a pod gets deleted
-		DeleteFunc: func(interface{}) {
-			// TODO: unregister
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if crd, ok := obj.(*v1.CustomResourceDefinition); ok {
+				registry.UnregisterCustomResourceDefinition(crd)
+			}
 		},
 	})
 	// You need to start the informer, in my case, it runs in the background
 	go informer.Run(stopCh)
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPatchOperation is an operation of a JSON Patch (RFC 6902).
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// createJSONPatch returns the operations that turn original into modified, two unstructured values
+// at the JSON pointer path. Object members are added, removed and patched individually, as are the
+// items of lists that keep their length; any other change replaces the value.
+func createJSONPatch(path string, original, modified interface{}) []jsonPatchOperation {
+	switch o := original.(type) {
+	case map[string]interface{}:
+		m, ok := modified.(map[string]interface{})
+		if !ok {
+			break
+		}
+		var ops []jsonPatchOperation
+		for _, key := range sortedKeys(o) {
+			if _, ok := m[key]; !ok {
+				ops = append(ops, jsonPatchOperation{Op: "remove", Path: path + "/" + jsonPointerEscaper.Replace(key)})
+			}
+		}
+		for _, key := range sortedKeys(m) {
+			keyPath := path + "/" + jsonPointerEscaper.Replace(key)
+			if value, ok := o[key]; ok {
+				ops = append(ops, createJSONPatch(keyPath, value, m[key])...)
+			} else {
+				ops = append(ops, jsonPatchOperation{Op: "add", Path: keyPath, Value: m[key]})
+			}
+		}
+		return ops
+	case []interface{}:
+		l, ok := modified.([]interface{})
+		if !ok || len(l) != len(o) {
+			break
+		}
+		var ops []jsonPatchOperation
+		for i := range o {
+			ops = append(ops, createJSONPatch(path+"/"+strconv.Itoa(i), o[i], l[i])...)
+		}
+		return ops
+	}
+	if reflect.DeepEqual(original, modified) {
+		return nil
+	}
+	return []jsonPatchOperation{{Op: "replace", Path: path, Value: modified}}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
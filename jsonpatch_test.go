@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCreateJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		expected string
+	}{
+		{
+			name:     "unchanged",
+			original: `{"spec":{"a":1,"l":[1,2]}}`,
+			modified: `{"spec":{"a":1,"l":[1,2]}}`,
+			expected: `null`,
+		},
+		{
+			name:     "add to existing parent",
+			original: `{"spec":{}}`,
+			modified: `{"spec":{"a":1}}`,
+			expected: `[{"op":"add","path":"/spec/a","value":1}]`,
+		},
+		{
+			name:     "add to missing parent",
+			original: `{}`,
+			modified: `{"spec":{"a":{"b":1}}}`,
+			expected: `[{"op":"add","path":"/spec","value":{"a":{"b":1}}}]`,
+		},
+		{
+			name:     "remove",
+			original: `{"spec":{"a":1,"b":2}}`,
+			modified: `{"spec":{"b":2}}`,
+			expected: `[{"op":"remove","path":"/spec/a"}]`,
+		},
+		{
+			name:     "removes before adds",
+			original: `{"spec":{"b":1}}`,
+			modified: `{"spec":{"a":1}}`,
+			expected: `[{"op":"remove","path":"/spec/b"},{"op":"add","path":"/spec/a","value":1}]`,
+		},
+		{
+			name:     "replace scalar",
+			original: `{"spec":{"a":1}}`,
+			modified: `{"spec":{"a":"x"}}`,
+			expected: `[{"op":"replace","path":"/spec/a","value":"x"}]`,
+		},
+		{
+			name:     "replace object with scalar",
+			original: `{"spec":{"a":{"b":1}}}`,
+			modified: `{"spec":{"a":1}}`,
+			expected: `[{"op":"replace","path":"/spec/a","value":1}]`,
+		},
+		{
+			name:     "patch items of list of same length",
+			original: `{"spec":{"l":[{"a":1},{"a":2}]}}`,
+			modified: `{"spec":{"l":[{"a":1},{"a":2,"b":3}]}}`,
+			expected: `[{"op":"add","path":"/spec/l/1/b","value":3}]`,
+		},
+		{
+			name:     "replace list whose length changed",
+			original: `{"spec":{"l":[{"a":1},{"a":2}]}}`,
+			modified: `{"spec":{"l":[{"a":1}]}}`,
+			expected: `[{"op":"replace","path":"/spec/l","value":[{"a":1}]}]`,
+		},
+		{
+			name:     "escape ~ and / in keys",
+			original: `{"metadata":{"annotations":{"a~b/c":"x"}}}`,
+			modified: `{"metadata":{"annotations":{"a~b/c":"y","d/e~f":"z"}}}`,
+			expected: `[{"op":"replace","path":"/metadata/annotations/a~0b~1c","value":"y"},{"op":"add","path":"/metadata/annotations/d~1e~0f","value":"z"}]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var original, modified interface{}
+			if err := json.Unmarshal([]byte(tc.original), &original); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.modified), &modified); err != nil {
+				t.Fatal(err)
+			}
+			patch, err := json.Marshal(createJSONPatch("", original, modified))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, patch)
+			}
+		})
+	}
+}
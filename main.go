@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -19,16 +22,20 @@ import (
 )
 
 var (
-	certFile string
-	keyFile  string
-	port     int
+	certFile           string
+	keyFile            string
+	port               int
+	legacyFormatRules  bool
+	pruneUnknownFields bool
+	staticCostBudget   int64
+	runtimeCostLimit   int64
 )
 
 // CmdWebhook is used by agnhost Cobra.
 var CmdWebhook = &cobra.Command{
 	Use:   "webhook",
-	Short: "Starts a Kubernetes webhook that performs custom validation",
-	Long:  `Starts a Kubernetes webhook that performs custom validation`,
+	Short: "Starts a Kubernetes webhook that performs custom validation, defaulting and conversion",
+	Long:  `Starts a Kubernetes webhook that performs custom validation, defaulting and conversion`,
 	Args:  cobra.MaximumNArgs(0),
 	Run:   runCmdWebhook,
 }
@@ -40,16 +47,47 @@ func init() {
 		"File containing the default x509 private key matching --tls-cert-file.")
 	CmdWebhook.Flags().IntVar(&port, "port", 443,
 		"Secure port that the webhook listens on")
+	CmdWebhook.Flags().BoolVar(&legacyFormatRules, "legacy-format-rules", true,
+		"Also run validation rules declared in the format of schema nodes as \"validation:<rule>\". Rules declared in the rules annotation of the CRD are always run.")
+	CmdWebhook.Flags().BoolVar(&pruneUnknownFields, "prune-unknown-fields", true,
+		"Prune the fields of custom resources not declared by their schema when the mutating webhook defaults them, as the apiserver does. Validation sees objects as received. CRDs with spec.preserveUnknownFields are never pruned.")
+	CmdWebhook.Flags().Int64Var(&staticCostBudget, "rule-cost-budget", validators.DefaultStaticCostBudget,
+		"Maximum estimated worst case cost of a rule. CRDs with rules that may exceed it are rejected. 0 disables the check.")
+	CmdWebhook.Flags().Int64Var(&runtimeCostLimit, "rule-runtime-cost-limit", validators.DefaultRuntimeCostLimit,
+		"Maximum cost of the rule evaluations of a request. Evaluations that exceed it are aborted and the request is rejected. 0 disables the limit.")
 }
 
+var (
+	// webhookRequests is the number of reviews received by each endpoint, by path. Published at
+	// /debug/vars.
+	webhookRequests = expvar.NewMap("webhook_requests")
+	// webhookBadRequests is the number of requests rejected by each endpoint because they could not be
+	// decoded or held a review of a kind the endpoint does not serve, by path.
+	webhookBadRequests = expvar.NewMap("webhook_bad_requests")
+)
+
+// defaultRequestTimeout is the timeout of requests that do not specify one. It matches the
+// timeoutSeconds of the webhook configuration in example/crontab/webhook-template.yaml.
+const defaultRequestTimeout = 5 * time.Second
+
 // admitv1beta1Func handles a v1 admission
-type admitv1Func func(v1.AdmissionReview) *v1.AdmissionResponse
+type admitv1Func func(context.Context, v1.AdmissionReview) *v1.AdmissionResponse
 
-type convertv1Func func(extensionsv1.ConversionReview) *extensionsv1.ConversionResponse
+type convertv1Func func(context.Context, extensionsv1.ConversionReview) *extensionsv1.ConversionResponse
 
-// serve handles the http portion of a request prior to handing to an admit
-// function
+// serve handles the http portion of a request prior to handing to an admit or convert function.
+// Each endpoint serves a single kind of review, so one of admit and convert is nil, and reviews of
+// the other kind are rejected.
 func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func, convert convertv1Func) {
+	// The apiserver passes the webhook timeout as the timeout query parameter, and closes the
+	// connection, cancelling the request context, once it expires.
+	timeout := defaultRequestTimeout
+	if t, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && t > 0 {
+		timeout = t
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -69,15 +107,19 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func, convert co
 	deserializer := codecs.UniversalDeserializer()
 	obj, gvk, err := deserializer.Decode(body, nil, nil)
 	if err != nil {
-		msg := fmt.Sprintf("Request could not be decoded: %v", err)
-		klog.Error(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		badRequest(w, r, fmt.Sprintf("Request could not be decoded: %v", err))
 		return
 	}
+	webhookRequests.Add(r.URL.Path, 1)
+	klog.V(4).Infof("%s: handling %v", r.URL.Path, gvk)
 
 	var responseObj runtime.Object
 	switch *gvk {
 	case v1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		if admit == nil {
+			badRequest(w, r, fmt.Sprintf("%s does not accept %s, admission reviews are served at /validate and /mutate", r.URL.Path, gvk.Kind))
+			return
+		}
 		requestedAdmissionReview, ok := obj.(*v1.AdmissionReview)
 		if !ok {
 			klog.Errorf("Expected v1.AdmissionReview but got: %T", obj)
@@ -85,10 +127,14 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func, convert co
 		}
 		responseAdmissionReview := &v1.AdmissionReview{}
 		responseAdmissionReview.SetGroupVersionKind(*gvk)
-		responseAdmissionReview.Response = admit(*requestedAdmissionReview)
+		responseAdmissionReview.Response = admit(ctx, *requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 		responseObj = responseAdmissionReview
 	case extensionsv1.SchemeGroupVersion.WithKind("ConversionReview"):
+		if convert == nil {
+			badRequest(w, r, fmt.Sprintf("%s does not accept %s, conversion reviews are served at /convert", r.URL.Path, gvk.Kind))
+			return
+		}
 		requestedConversionReview, ok := obj.(*extensionsv1.ConversionReview)
 		if !ok {
 			klog.Errorf("Expected v1.ConversionReview but got: %T", obj)
@@ -96,13 +142,11 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func, convert co
 		}
 		responseConversionReview := &extensionsv1.ConversionReview{}
 		responseConversionReview.SetGroupVersionKind(*gvk)
-		responseConversionReview.Response = convert(*requestedConversionReview)
+		responseConversionReview.Response = convert(ctx, *requestedConversionReview)
 		responseConversionReview.Response.UID = requestedConversionReview.Request.UID
 		responseObj = responseConversionReview
 	default:
-		msg := fmt.Sprintf("Unsupported group version kind: %v", gvk)
-		klog.Error(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		badRequest(w, r, fmt.Sprintf("Unsupported group version kind: %v", gvk))
 		return
 	}
 
@@ -118,25 +162,43 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func, convert co
 	}
 }
 
+// badRequest rejects a request that an endpoint cannot serve.
+func badRequest(w http.ResponseWriter, r *http.Request, msg string) {
+	webhookBadRequests.Add(r.URL.Path, 1)
+	klog.Errorf("%s: %s", r.URL.Path, msg)
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
 func runCmdWebhook(cmd *cobra.Command, args []string) {
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 	validator := newFormatValidators()
+	validator.legacyFormatRules = legacyFormatRules
+	validator.pruneUnknownFields = pruneUnknownFields
+
+	// Validators are registered before the informer starts so that the rules of existing CRDs are
+	// compiled by them.
+	celValidator := validators.NewCelValidator()
+	celValidator.StaticCostBudget = staticCostBudget
+	celValidator.RuntimeCostLimit = runtimeCostLimit
+	validator.registerFormat(celValidatorId, celValidator)
+	validator.registerConverter(celConverterId, celValidator)
+	validator.registerDefaulter(celDefaulterId, celValidator)
+
 	err := informers.StartCRDInformer(validator, stopCh)
 	if err != nil {
 		panic(err)
 	}
 
-	celValidator := validators.NewCelValidator()
-	validator.registerFormat("validation", celValidator)
-	validator.registerConverter("conversion", celValidator)
-
 	config := Config{
 		CertFile: certFile,
 		KeyFile:  keyFile,
 	}
 
 	http.HandleFunc("/validate", validator.serveValidateRequest)
+	http.HandleFunc("/mutate", validator.serveMutateRequest)
+	http.HandleFunc("/convert", validator.serveConvertRequest)
+	http.HandleFunc("/debug/crds", validator.statuses.serveCRDStatus)
 	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) })
 	server := &http.Server{
 		Addr:      fmt.Sprintf(":%d", port),
@@ -155,6 +217,7 @@ func main() {
 	}
 
 	rootCmd.AddCommand(CmdWebhook)
+	rootCmd.AddCommand(CmdCheckConversion)
 	loggingFlags := &flag.FlagSet{}
 	klog.InitFlags(loggingFlags)
 	rootCmd.PersistentFlags().AddGoFlagSet(loggingFlags)
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeEndpoints(t *testing.T) {
+	v := newTestValidators(t)
+	conversion := `{"apiVersion":"apiextensions.k8s.io/v1","kind":"ConversionReview","request":{"uid":"1","desiredAPIVersion":"example.com/v2","objects":[]}}`
+	admission := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1","operation":"CREATE","object":{"apiVersion":"example.com/v1","kind":"Widget"}}}`
+	tests := []struct {
+		path         string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{path: "/validate", body: admission, expectedCode: http.StatusOK, expectedBody: `"allowed":true`},
+		{path: "/mutate", body: admission, expectedCode: http.StatusOK, expectedBody: `"allowed":true`},
+		{path: "/convert", body: conversion, expectedCode: http.StatusOK, expectedBody: `"status":"Success"`},
+		{path: "/validate", body: conversion, expectedCode: http.StatusBadRequest, expectedBody: "conversion reviews are served at /convert"},
+		{path: "/mutate", body: conversion, expectedCode: http.StatusBadRequest, expectedBody: "conversion reviews are served at /convert"},
+		{path: "/convert", body: admission, expectedCode: http.StatusBadRequest, expectedBody: "admission reviews are served at /validate and /mutate"},
+		{path: "/validate", body: `{`, expectedCode: http.StatusBadRequest, expectedBody: "Request could not be decoded"},
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/validate": v.serveValidateRequest,
+		"/mutate":   v.serveMutateRequest,
+		"/convert":  v.serveConvertRequest,
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			requests, badRequests := expvarInt(webhookRequests, tc.path), expvarInt(webhookBadRequests, tc.path)
+			r := httptest.NewRequest("POST", tc.path, bytes.NewBufferString(tc.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handlers[tc.path](w, r)
+			if w.Code != tc.expectedCode || !strings.Contains(w.Body.String(), tc.expectedBody) {
+				t.Errorf("expected %d containing %q, got %d %s", tc.expectedCode, tc.expectedBody, w.Code, w.Body.String())
+			}
+			if tc.expectedCode == http.StatusBadRequest {
+				badRequests++
+			}
+			if tc.expectedBody != "Request could not be decoded" {
+				requests++
+			}
+			if got := expvarInt(webhookRequests, tc.path); got != requests {
+				t.Errorf("expected %d requests, got %d", requests, got)
+			}
+			if got := expvarInt(webhookBadRequests, tc.path); got != badRequests {
+				t.Errorf("expected %d bad requests, got %d", badRequests, got)
+			}
+		})
+	}
+}
+
+// expvarInt returns the value of key in m, or zero if it is not set.
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
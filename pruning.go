@@ -0,0 +1,60 @@
+package main
+
+import (
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// prune removes the fields of obj that are not declared by schema, as the apiserver does when
+// persisting custom resources. Fields of objects with x-kubernetes-preserve-unknown-fields are kept,
+// as are the apiVersion, kind and metadata of the root object and of embedded resources, which are
+// never pruned with the schema of the CRD, even if it declares them. root is set if obj is the root of
+// a custom resource. Returns whether obj was changed.
+func prune(schema *apiextensionsv1.JSONSchemaProps, obj interface{}, root bool) bool {
+	if schema == nil {
+		return false
+	}
+	var changed bool
+	switch schema.Type {
+	case "object":
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		preserve := schema.XPreserveUnknownFields != nil && *schema.XPreserveUnknownFields
+		for key, value := range m {
+			if (root || schema.XEmbeddedResource) && isTypeMetaOrObjectMeta(key) {
+				continue
+			}
+			if prop, ok := schema.Properties[key]; ok {
+				changed = prune(&prop, value, false) || changed
+				continue
+			}
+			if schema.AdditionalProperties != nil {
+				if schema.AdditionalProperties.Schema != nil {
+					changed = prune(schema.AdditionalProperties.Schema, value, false) || changed
+				}
+				if schema.AdditionalProperties.Schema != nil || schema.AdditionalProperties.Allows {
+					continue
+				}
+			}
+			if preserve {
+				continue
+			}
+			delete(m, key)
+			changed = true
+		}
+	case "array":
+		items, ok := obj.([]interface{})
+		if !ok || schema.Items == nil {
+			return false
+		}
+		for _, item := range items {
+			changed = prune(schema.Items.Schema, item, false) || changed
+		}
+	}
+	return changed
+}
+
+func isTypeMetaOrObjectMeta(key string) bool {
+	return key == "apiVersion" || key == "kind" || key == "metadata"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name        string
+		schema      string
+		obj         string
+		expected    string
+		wantChanged bool
+	}{
+		{
+			name:        "unknown fields",
+			schema:      `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}`,
+			obj:         `{"spec":{"a":"x","b":"y"},"other":1}`,
+			expected:    `{"spec":{"a":"x"}}`,
+			wantChanged: true,
+		},
+		{
+			name:     "no unknown fields",
+			schema:   `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}`,
+			obj:      `{"spec":{"a":"x"}}`,
+			expected: `{"spec":{"a":"x"}}`,
+		},
+		{
+			name:     "type and object meta of the root",
+			schema:   `{"type":"object","properties":{"spec":{"type":"object"}}}`,
+			obj:      `{"apiVersion":"v1","kind":"K","metadata":{"name":"n","namespace":"ns","labels":{"l":"v"},"uid":"u"}}`,
+			expected: `{"apiVersion":"v1","kind":"K","metadata":{"name":"n","namespace":"ns","labels":{"l":"v"},"uid":"u"}}`,
+		},
+		{
+			name:     "declared metadata without properties",
+			schema:   `{"type":"object","properties":{"metadata":{"type":"object"}}}`,
+			obj:      `{"metadata":{"name":"n","namespace":"ns","labels":{"l":"v"},"uid":"u"}}`,
+			expected: `{"metadata":{"name":"n","namespace":"ns","labels":{"l":"v"},"uid":"u"}}`,
+		},
+		{
+			name:     "declared metadata with properties",
+			schema:   `{"type":"object","properties":{"metadata":{"type":"object","properties":{"name":{"type":"string"}}}}}`,
+			obj:      `{"metadata":{"name":"n","namespace":"ns","labels":{"l":"v"},"uid":"u"}}`,
+			expected: `{"metadata":{"name":"n","namespace":"ns","labels":{"l":"v"},"uid":"u"}}`,
+		},
+		{
+			name:        "metadata of nested objects",
+			schema:      `{"type":"object","properties":{"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}`,
+			obj:         `{"spec":{"a":"x","metadata":{"name":"n"}}}`,
+			expected:    `{"spec":{"a":"x"}}`,
+			wantChanged: true,
+		},
+		{
+			name:        "embedded resources",
+			schema:      `{"type":"object","properties":{"template":{"type":"object","x-kubernetes-embedded-resource":true,"properties":{"metadata":{"type":"object"},"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}}}`,
+			obj:         `{"template":{"apiVersion":"v1","kind":"K","metadata":{"name":"n","labels":{"l":"v"}},"spec":{"a":"x","b":"y"}}}`,
+			expected:    `{"template":{"apiVersion":"v1","kind":"K","metadata":{"name":"n","labels":{"l":"v"}},"spec":{"a":"x"}}}`,
+			wantChanged: true,
+		},
+		{
+			name:     "preserve unknown fields",
+			schema:   `{"type":"object","properties":{"spec":{"type":"object","x-kubernetes-preserve-unknown-fields":true,"properties":{"a":{"type":"object","properties":{}}}}}}`,
+			obj:      `{"spec":{"b":"y","a":{}}}`,
+			expected: `{"spec":{"b":"y","a":{}}}`,
+		},
+		{
+			name:        "preserve unknown fields does not apply to declared properties",
+			schema:      `{"type":"object","properties":{"spec":{"type":"object","x-kubernetes-preserve-unknown-fields":true,"properties":{"a":{"type":"object","properties":{}}}}}}`,
+			obj:         `{"spec":{"a":{"c":1}}}`,
+			expected:    `{"spec":{"a":{}}}`,
+			wantChanged: true,
+		},
+		{
+			name:        "additionalProperties schemas",
+			schema:      `{"type":"object","properties":{"m":{"type":"object","additionalProperties":{"type":"object","properties":{"a":{"type":"string"}}}}}}`,
+			obj:         `{"m":{"k":{"a":"x","b":"y"}}}`,
+			expected:    `{"m":{"k":{"a":"x"}}}`,
+			wantChanged: true,
+		},
+		{
+			name:     "additionalProperties allowed",
+			schema:   `{"type":"object","properties":{"m":{"type":"object","additionalProperties":true}}}`,
+			obj:      `{"m":{"k":{"a":"x"}}}`,
+			expected: `{"m":{"k":{"a":"x"}}}`,
+		},
+		{
+			name:        "list items",
+			schema:      `{"type":"object","properties":{"l":{"type":"array","items":{"type":"object","properties":{"a":{"type":"string"}}}}}}`,
+			obj:         `{"l":[{"a":"x","b":"y"},{"c":"z"}]}`,
+			expected:    `{"l":[{"a":"x"},{}]}`,
+			wantChanged: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var schema apiextensionsv1.JSONSchemaProps
+			if err := json.Unmarshal([]byte(tc.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			var obj, expected map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.obj), &obj); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.expected), &expected); err != nil {
+				t.Fatal(err)
+			}
+			changed := prune(&schema, obj, true)
+			if changed != tc.wantChanged {
+				t.Errorf("expected changed=%t but got %t", tc.wantChanged, changed)
+			}
+			if !reflect.DeepEqual(obj, expected) {
+				got, _ := json.Marshal(obj)
+				t.Errorf("expected %s but got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestMutateRequestKeepsObjectMeta(t *testing.T) {
+	v := newTestValidators(t, widgetCRD([2]string{"v1", `{"type":"object","properties":{
+		"metadata":{"type":"object","properties":{"name":{"type":"string"}}},
+		"spec":{"type":"object","properties":{"a":{"type":"string"}}}}}`}))
+	obj := widget(t, "v1", `{"a":"x","b":"y"}`)
+	obj["metadata"] = map[string]interface{}{"name": "w", "namespace": "default", "labels": map[string]interface{}{"l": "v"}, "uid": "u"}
+
+	resp := v.mutateRequest(context.Background(), admissionReview(t, v1.Create, obj, nil))
+	if !resp.Allowed {
+		t.Fatalf("expected mutation to be allowed, got %v", resp.Result)
+	}
+	expected := `[{"op":"remove","path":"/spec/b"}]`
+	if string(resp.Patch) != expected {
+		t.Errorf("expected patch %s, got %s", expected, resp.Patch)
+	}
+}
+
+func TestValidateRequestSeesObjectMeta(t *testing.T) {
+	v := newTestValidators(t, withRules(t, widgetCRD([2]string{"v1", `{"type":"object",
+		"properties":{"metadata":{"type":"object"},"spec":{"type":"object"}}}`}),
+		`[{"version":"v1","validations":[{"rule":"self.metadata.namespace == 'default' && 'l' in self.metadata.labels"}]}]`))
+	obj := widget(t, "v1", `{}`)
+	obj["metadata"] = map[string]interface{}{"name": "w", "namespace": "default", "labels": map[string]interface{}{"l": "v"}}
+
+	resp := v.validateRequest(context.Background(), admissionReview(t, v1.Create, obj, nil))
+	if !resp.Allowed {
+		t.Errorf("expected validation to be allowed, got %v", resp.Result)
+	}
+}
@@ -1,144 +1,405 @@
 package validators
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
 	celext "github.com/google/cel-go/ext"
 	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 )
 
+const (
+	// SelfVar is the variable bound to the value of the schema node a rule is attached to.
+	SelfVar = "self"
+	// RootVar is the variable bound to the full object being validated.
+	RootVar = "root"
+	// OldSelfVar is the variable bound to the value of the schema node in the old object on update.
+	// Rules that reference it are transition rules and are only evaluated when the old value exists.
+	OldSelfVar = "oldSelf"
+)
+
+// compiledProgram is a CEL program compiled for a schema node.
+type compiledProgram struct {
+	cel.Program
+	// transition is true if the program references oldSelf.
+	transition bool
+}
+
+// programKey identifies a compiled program. Programs are scoped to the generation of the
+// CustomResourceDefinition they were compiled for, since each generation may change the schema the
+// program was type-checked against.
+type programKey struct {
+	uid        types.UID
+	generation int64
+	version    string
+	path       string
+	rule       string
+	// conversion is true for programs compiled by Convert, which are compiled against the schema
+	// node instead of the root schema.
+	conversion bool
+	// targetVersion is set for conversion rules declared at the root of the CustomResourceDefinition,
+	// whose path is that of the field they set in the target version.
+	targetVersion string
+	// message is true for the message expressions of validation rules, which must evaluate to a string
+	// instead of a bool.
+	message bool
+	// defaulting is true for default rules, whose path is that of the defaulted property.
+	defaulting bool
+}
+
+// programCacheEntry is the result of compiling a program. Compile errors are cached as well so that
+// broken rules are not recompiled for every request.
+type programCacheEntry struct {
+	program *compiledProgram
+	err     error
+}
+
 type CelValidator struct {
-	compiledPrograms map[string]cel.Program
+	// StaticCostBudget is the maximum estimated worst case cost of a rule. Rules that may exceed it
+	// fail to compile. Zero disables the check.
+	StaticCostBudget int64
+	// RuntimeCostLimit is the maximum cost of the evaluations sharing a runtime cost budget, such as
+	// those of a request, or of a single evaluation given a context without a budget. Evaluations
+	// that exceed it are aborted. Zero disables the limit.
+	RuntimeCostLimit int64
+
+	lock             sync.RWMutex
+	compiledPrograms map[programKey]programCacheEntry
+	// generations holds the generation of each registered CustomResourceDefinition. Only programs
+	// compiled for a registered generation are cached.
+	generations map[types.UID]int64
 }
 
 func NewCelValidator() *CelValidator {
-	v := &CelValidator{}
-	v.compiledPrograms = map[string]cel.Program{}
+	v := &CelValidator{StaticCostBudget: DefaultStaticCostBudget, RuntimeCostLimit: DefaultRuntimeCostLimit}
+	v.compiledPrograms = map[programKey]programCacheEntry{}
+	v.generations = map[types.UID]int64{}
 	return v
 }
 
-func (v *CelValidator) compileProgram(fieldpath []string, celSource string, schema *apiextensionsv1.JSONSchemaProps) (cel.Program, error) {
-	programPath := "/" + strings.Join(fieldpath, "/")
-	// TODO: reenable once program caching is scoped to crd and invalidation is in place for crd reloads
-	//if program, ok := v.compiledPrograms[programPath]; ok {
-	//	return program, nil
-	//}
+// RegisterCustomResourceDefinition invalidates the programs compiled for previous generations of crd.
+func (v *CelValidator) RegisterCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.generations[crd.UID] = crd.Generation
+	for key := range v.compiledPrograms {
+		if key.uid == crd.UID && key.generation != crd.Generation {
+			delete(v.compiledPrograms, key)
+		}
+	}
+}
+
+// UnregisterCustomResourceDefinition invalidates all programs compiled for crd.
+func (v *CelValidator) UnregisterCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.generations, crd.UID)
+	for key := range v.compiledPrograms {
+		if key.uid == crd.UID {
+			delete(v.compiledPrograms, key)
+		}
+	}
+}
+
+// program returns the program for key from the cache, compiling and caching it on a cache miss.
+func (v *CelValidator) program(key programKey, compile func() (*compiledProgram, error)) (*compiledProgram, error) {
+	if len(key.uid) == 0 {
+		return compile()
+	}
+	v.lock.RLock()
+	entry, ok := v.compiledPrograms[key]
+	v.lock.RUnlock()
+	if ok {
+		return entry.program, entry.err
+	}
+	program, err := compile()
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if generation, ok := v.generations[key.uid]; ok && generation == key.generation {
+		v.compiledPrograms[key] = programCacheEntry{program: program, err: err}
+	}
+	return program, err
+}
+
+// validationProgram returns the program of a validation rule of the schema node at fieldpath.
+func (v *CelValidator) validationProgram(fieldpath []string, celSource string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) (*compiledProgram, error) {
+	key := programKey{uid: crd.UID, generation: crd.Generation, version: crd.Version, path: "/" + strings.Join(fieldpath, "/"), rule: celSource}
+	return v.program(key, func() (*compiledProgram, error) {
+		return v.compileProgram(fieldpath, celSource, crd.Schema, schema, decls.Bool)
+	})
+}
+
+// messageProgram returns the program of the message expression of a validation rule of the schema
+// node at fieldpath.
+func (v *CelValidator) messageProgram(fieldpath []string, celSource string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) (*compiledProgram, error) {
+	key := programKey{uid: crd.UID, generation: crd.Generation, version: crd.Version, path: "/" + strings.Join(fieldpath, "/"), rule: celSource, message: true}
+	return v.program(key, func() (*compiledProgram, error) {
+		return v.compileProgram(fieldpath, celSource, crd.Schema, schema, decls.String)
+	})
+}
+
+// conversionProgram returns the program of a conversion rule of the schema node at fieldpath.
+// Conversion rules are compiled with the current schema node as their root.
+func (v *CelValidator) conversionProgram(fieldpath []string, celSource string, current CRDVersion, currentSchema *apiextensionsv1.JSONSchemaProps) (*compiledProgram, error) {
+	key := programKey{uid: current.UID, generation: current.Generation, version: current.Version, path: "/" + strings.Join(fieldpath, "/"), rule: celSource, conversion: true}
+	return v.program(key, func() (*compiledProgram, error) {
+		return v.compileProgram([]string{}, celSource, currentSchema, currentSchema, nil) // Schema is expected to be the old schema (for now)
+	})
+}
+
+// objectConversionProgram returns the program of a conversion rule declared at the root of the
+// CustomResourceDefinition. The rule is bound to the object being converted, and must evaluate to a
+// value of the type of the field it sets in the target version.
+func (v *CelValidator) objectConversionProgram(rule FieldConversionRule, current, target CRDVersion) (*compiledProgram, error) {
+	key := programKey{uid: current.UID, generation: current.Generation, version: current.Version, path: "/" + strings.Join(rule.Path(), "/"), rule: rule.Rule, conversion: true, targetVersion: target.Version}
+	return v.program(key, func() (*compiledProgram, error) {
+		fieldSchema, err := SchemaAt(target.Schema, rule.Path())
+		if err != nil {
+			return nil, err
+		}
+		prg, err := v.compileProgram(nil, rule.Rule, current.Schema, current.Schema, scalarType(fieldSchema))
+		if err != nil {
+			return nil, err
+		}
+		if prg.transition {
+			return nil, fmt.Errorf("conversion rules cannot reference %s", OldSelfVar)
+		}
+		return prg, nil
+	})
+}
+
+// defaultProgram returns the program of the default rule of the property propName of the object
+// schema node at fieldpath. Default rules are bound to the object holding the property, and must
+// evaluate to a value of the type of the property.
+func (v *CelValidator) defaultProgram(fieldpath []string, propName, celSource string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) (*compiledProgram, error) {
+	key := programKey{uid: crd.UID, generation: crd.Generation, version: crd.Version, path: "/" + strings.Join(append(append([]string{}, fieldpath...), propName), "/"), rule: celSource, defaulting: true}
+	return v.program(key, func() (*compiledProgram, error) {
+		prop, ok := schema.Properties[propName]
+		if !ok {
+			return nil, fmt.Errorf("no schema for property %s", propName)
+		}
+		prg, err := v.compileProgram(fieldpath, celSource, crd.Schema, schema, scalarType(&prop))
+		if err != nil {
+			return nil, err
+		}
+		if prg.transition {
+			return nil, fmt.Errorf("default rules cannot reference %s", OldSelfVar)
+		}
+		return prg, nil
+	})
+}
 
-	celDecls := v.buildDecl([]string{}, schema)
+// compileProgram compiles celSource for the schema node at fieldpath. Rules are bound to the node
+// value as self, to its old value as oldSelf, and to the full object as root. The properties of
+// object nodes are also declared as variables, so rules written before self was introduced keep
+// working. If resultType is set, the expression must evaluate to a value of that type, or be dynamically
+// typed.
+func (v *CelValidator) compileProgram(fieldpath []string, celSource string, rootSchema, schema *apiextensionsv1.JSONSchemaProps, resultType *expr.Type) (*compiledProgram, error) {
+	provider, err := newSchemaTypeProvider("#", rootSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing CEL type provider: %w", err)
+	}
+	typeName, err := typeNameAt("#", rootSchema, fieldpath)
+	if err != nil {
+		return nil, err
+	}
+	celDecls := v.buildDecl(provider, provider.buildType(typeName, schema))
 	env, err := cel.NewEnv(
+		cel.CustomTypeProvider(provider),
 		celext.Strings(),
 		celext.Encoders(),
+		KubernetesValidation(),
+		Quantities(),
+		Times(),
+		Regex(),
+		Network(),
+		Crons(),
+		Semvers(),
 		cel.Declarations(celDecls...))
 	if err != nil {
 		return nil, fmt.Errorf("error initializing CEL environment: %w", err)
 	}
 	ast, issues := env.Compile(celSource)
 	if issues != nil && issues.Err() != nil {
-		var decls string
-		for _, decl := range celDecls {
-			decls += fmt.Sprintf("%s, ", decl.Name)
-
-		}
 		return nil, fmt.Errorf("parse error for validation expression '%s': %w", celSource, issues.Err())
 	}
 	ast, issues = env.Check(ast)
 	if issues != nil && issues.Err() != nil {
 		return nil, fmt.Errorf("CEL type-check error: %w", issues.Err())
 	}
-	// TODO: this program is cachable and absolutely should be cached
-	prg, err := env.Program(ast)
+	if err := checkConstantArgs(ast.Expr()); err != nil {
+		return nil, fmt.Errorf("CEL type-check error: %w", err)
+	}
+	if resultType != nil && !proto.Equal(ast.ResultType(), resultType) && !proto.Equal(ast.ResultType(), decls.Dyn) {
+		return nil, fmt.Errorf("CEL type-check error: expected expression to evaluate to %s but got %s", cel.FormatType(resultType), cel.FormatType(ast.ResultType()))
+	}
+	if v.StaticCostBudget > 0 {
+		if cost := estimateCost(ast.Expr(), rootSchema, schema); cost > v.StaticCostBudget {
+			return nil, fmt.Errorf("estimated worst case cost %d exceeds the budget of %d, consider setting maxItems, maxProperties or maxLength on the fields the expression iterates over", cost, v.StaticCostBudget)
+		}
+	}
+	prg, err := env.Program(ast, cel.CustomDecorator(decorateCost))
 	if err != nil {
 		return nil, fmt.Errorf("CEL program construction error: %w", err)
 	}
-	v.compiledPrograms[programPath] = prg
-	return prg, nil
-}
-
-func (v *CelValidator) buildDecl(fieldpath []string, schema *apiextensionsv1.JSONSchemaProps) []*expr.Decl {
-	var celDecls []*expr.Decl
-	switch schema.Type {
-	case "object":
-		for k, prop := range schema.Properties {
-			celDecls = append(celDecls, v.buildDecl(append(fieldpath, k), &prop)...)
-		}
-	case "array":
-		// TODO support properly with type checking
-		fieldName := strings.Join(fieldpath, ".")
-		celDecls = append(celDecls, decls.NewVar(fieldName, decls.NewListType(decls.Dyn)))
-	case "string":
-		fieldName := strings.Join(fieldpath, ".")
-		celDecls = append(celDecls, decls.NewVar(fieldName, decls.String))
-	case "integer":
-		fieldName := strings.Join(fieldpath, ".")
-		celDecls = append(celDecls, decls.NewVar(fieldName, decls.Int))
-	case "number":
-		fieldName := strings.Join(fieldpath, ".")
-		celDecls = append(celDecls, decls.NewVar(fieldName, decls.Double))
-	case "boolean":
-		fieldName := strings.Join(fieldpath, ".")
-		celDecls = append(celDecls, decls.NewVar(fieldName, decls.Bool))
-	default:
-		// TODO: handle as error
+	return &compiledProgram{Program: prg, transition: referencesIdent(ast.Expr(), OldSelfVar)}, nil
+}
+
+// buildDecl declares the self, oldSelf and root variables, and a variable for each property of self
+// if it is an object. Properties are declared with their escaped names and the structured types
+// registered with the provider.
+func (v *CelValidator) buildDecl(provider *schemaTypeProvider, selfType *expr.Type) []*expr.Decl {
+	celDecls := []*expr.Decl{
+		decls.NewVar(SelfVar, selfType),
+		decls.NewVar(OldSelfVar, selfType),
+		decls.NewVar(RootVar, provider.rootType),
+	}
+	if selfObjectType, ok := provider.objectTypes[selfType.GetMessageType()]; ok {
+		for fieldName, ft := range selfObjectType.fields {
+			if isReservedVar(fieldName) {
+				continue
+			}
+			celDecls = append(celDecls, decls.NewVar(fieldName, ft.Type))
+		}
 	}
 	return celDecls
 }
 
-func (v *CelValidator) ValidateProgram(fieldpath []string, validatorContent string, schema *apiextensionsv1.JSONSchemaProps) error {
-	_, err := v.compileProgram(fieldpath, validatorContent, schema)
-	return err
+func (v *CelValidator) ValidateProgram(fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) error {
+	if _, err := v.validationProgram(fieldpath, rule.Rule, crd, schema); err != nil {
+		return err
+	}
+	if len(rule.MessageExpression) > 0 {
+		if _, err := v.messageProgram(fieldpath, rule.MessageExpression, crd, schema); err != nil {
+			return fmt.Errorf("messageExpression: %w", err)
+		}
+	}
+	return nil
 }
 
-func (v *CelValidator) Validate(fieldpath []string, celSource string, schema *apiextensionsv1.JSONSchemaProps, obj interface{}) error {
-	prg, err := v.compileProgram(fieldpath, celSource, schema)
+func (v *CelValidator) Validate(fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj, oldObj interface{}) error {
+	return v.ValidateContext(context.Background(), fieldpath, rule, crd, schema, root, obj, oldObj)
+}
+
+// ValidateContext evaluates rule against obj. The errors returned for rules that fail are shown to
+// users, so they carry the rule's message and never the rule itself or the values it was evaluated
+// against.
+func (v *CelValidator) ValidateContext(ctx context.Context, fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj, oldObj interface{}) error {
+	celSource := rule.Rule
+	prg, err := v.validationProgram(fieldpath, celSource, crd, schema)
 	if err != nil {
-		return fmt.Errorf("validation rule compile error: %w for: %#+v, rule: %s", err, obj, celSource)
+		return &CompileError{Err: fmt.Errorf("%w, rule: %s", err, celSource)}
+	}
+	if prg.transition && oldObj == nil {
+		return nil
 	}
 	celVars := map[string]interface{}{}
-	v.buildVars([]string{}, obj, celVars)
+	v.buildVars(crd.Schema, schema, root, obj, celVars)
+	if oldObj != nil {
+		celVars[OldSelfVar] = adaptToSchema(schema, oldObj)
+	}
+	tracker := newCostTracker(ctx, v.RuntimeCostLimit)
+	celVars[costTrackerVar] = tracker
 	out, _, err := prg.Eval(celVars)
+	if tracker.err != nil {
+		// Errors are absorbed by logical operators, so the evaluation may have been stopped without
+		// failing.
+		err = tracker.err
+	}
 	if err != nil {
-		return fmt.Errorf("validation rule evaluation error: %w for: %#+v, rule: %s", err, obj, celSource)
+		klog.V(2).Infof("validation rule evaluation error: %v for: %#+v, rule: %s", err, obj, celSource)
+		return fmt.Errorf("validation rule evaluation error: %w", err)
 	}
 	if out.Value() != true {
-		// TODO: Will need much better error reporting here
-		return fmt.Errorf("validation failed for: %s", celSource)
+		return errors.New(v.message(fieldpath, rule, crd, schema, celVars))
 	}
 	return nil
 }
 
-func (v *CelValidator) buildVars(fieldpath []string, obj interface{}, celVars map[string]interface{}) {
-	switch objVal := obj.(type) {
-	case map[string]interface{}:
-		for k, value := range objVal {
-			v.buildVars(append(fieldpath, k), value, celVars)
+// message returns the message of a failed rule: the result of its message expression if it evaluates
+// to a non-empty string, otherwise its static message, otherwise a generic message.
+func (v *CelValidator) message(fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, celVars map[string]interface{}) string {
+	if len(rule.MessageExpression) > 0 {
+		msg, err := v.evalMessage(fieldpath, rule.MessageExpression, crd, schema, celVars)
+		if err != nil {
+			klog.V(2).Infof("message expression error: %v, messageExpression: %s", err, rule.MessageExpression)
+		} else if len(strings.TrimSpace(msg)) > 0 {
+			return msg
+		}
+	}
+	if len(rule.Message) > 0 {
+		return rule.Message
+	}
+	return "failed validation rule"
+}
+
+func (v *CelValidator) evalMessage(fieldpath []string, celSource string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, celVars map[string]interface{}) (string, error) {
+	prg, err := v.messageProgram(fieldpath, celSource, crd, schema)
+	if err != nil {
+		return "", err
+	}
+	out, _, err := prg.Eval(celVars)
+	if err != nil {
+		return "", err
+	}
+	msg, ok := out.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("expected string but got %s", out.Type().TypeName())
+	}
+	return msg, nil
+}
+
+// buildVars binds the variables declared by buildDecl, except for oldSelf.
+func (v *CelValidator) buildVars(rootSchema, schema *apiextensionsv1.JSONSchemaProps, root, obj interface{}, celVars map[string]interface{}) {
+	celVars[SelfVar] = adaptToSchema(schema, obj)
+	celVars[RootVar] = adaptToSchema(rootSchema, root)
+	m, ok := obj.(map[string]interface{})
+	if !ok || schema.Type != "object" {
+		return
+	}
+	for propName, prop := range schema.Properties {
+		fieldName, ok := escapeName(propName)
+		if !ok || isReservedVar(fieldName) {
+			continue
+		}
+		if value, ok := lookupField(m, propName); ok {
+			prop := prop
+			celVars[fieldName] = adaptToSchema(&prop, value)
 		}
-	case []interface{}:
-		// TODO: handled in structured way
-		fieldName := strings.Join(fieldpath, ".")
-		celVars[fieldName] = obj
-	default:
-		fieldName := strings.Join(fieldpath, ".")
-		celVars[fieldName] = obj
 	}
 }
 
-// TODO: will probably need to walk both the old and new schemas
-// to support mapping rules like: from(v1): new.newfieldname := old.oldfieldname
-func (v *CelValidator) Convert(fieldpath []string, celSource string, currentVersion, targetVersion string, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error) {
-	klog.Infof("Running converter: %s on %v", celSource, fieldpath)
-	prg, err := v.compileProgram([]string{}, celSource, currentSchema) // Schema is expected to be the old schema (for now)
+// Convert evaluates a conversion rule declared in the format of a schema node against obj, the value
+// of the node in the current version, returning the value of the node in the target version. Rules
+// that map fields between versions are declared by ConversionRules, see ConvertObject.
+func (v *CelValidator) Convert(fieldpath []string, celSource string, current, target CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error) {
+	return v.ConvertContext(context.Background(), fieldpath, celSource, current, target, currentSchema, targetSchema, obj)
+}
+
+func (v *CelValidator) ConvertContext(ctx context.Context, fieldpath []string, celSource string, current, target CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error) {
+	klog.V(4).Infof("Running converter: %s on %v", celSource, fieldpath)
+	prg, err := v.conversionProgram(fieldpath, celSource, current, currentSchema)
 	if err != nil {
 		return nil, fmt.Errorf("conversion rule compile error: %w for: %#+v, rule: %s", err, obj, celSource)
 	}
 	celVars := map[string]interface{}{}
-	v.buildVars([]string{}, obj, celVars)
+	v.buildVars(currentSchema, currentSchema, obj, obj, celVars)
+	tracker := newCostTracker(ctx, v.RuntimeCostLimit)
+	celVars[costTrackerVar] = tracker
 	out, _, err := prg.Eval(celVars)
+	if tracker.err != nil {
+		err = tracker.err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("conversion rule evaluation error: %w for: %#+v, celVars: %#+v, rule: %s", err, obj, celVars, celSource)
 	}
@@ -147,14 +408,188 @@ func (v *CelValidator) Convert(fieldpath []string, celSource string, currentVers
 		return nil, err
 	}
 
-	// basic automatic conversion of things not manually converted
+	// Properties the rule does not set are copied if the target schema declares them with a compatible
+	// type.
 	if m, ok := obj.(map[string]interface{}); ok {
-		resultm := result.(map[string]interface{})
-		for k, v := range m {
-			if _, ok = resultm[k]; !ok {
-				resultm[k] = v
+		resultm, ok := result.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("conversion rule evaluation error: expected an object but got %T, rule: %s", result, celSource)
+		}
+		for k, value := range m {
+			if _, ok := resultm[k]; ok {
+				continue
+			}
+			prop, ok := targetSchema.Properties[k]
+			if !ok {
+				continue
+			}
+			currentProp := currentSchema.Properties[k]
+			converted, err := ConvertValue(&currentProp, &prop, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w, set it in the conversion rule: %s", k, err, celSource)
 			}
+			resultm[k] = converted
 		}
 	}
 	return result, nil
 }
+
+func (v *CelValidator) ValidateConversion(fieldpath []string, celSource string, current, target CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps) error {
+	_, err := v.conversionProgram(fieldpath, celSource, current, currentSchema)
+	return err
+}
+
+func (v *CelValidator) ValidateConversionRule(rule FieldConversionRule, current, target CRDVersion) error {
+	_, err := v.objectConversionProgram(rule, current, target)
+	return err
+}
+
+// ConvertObject evaluates each rule against obj and sets the field of converted it declares to the
+// result, in its unstructured form. Rules see obj as it was before conversion, never the fields set by
+// other rules.
+func (v *CelValidator) ConvertObject(ctx context.Context, rules ConversionRules, current, target CRDVersion, obj, converted map[string]interface{}) error {
+	celVars := map[string]interface{}{}
+	v.buildVars(current.Schema, current.Schema, obj, obj, celVars)
+	for _, rule := range rules.Rules {
+		prg, err := v.objectConversionProgram(rule, current, target)
+		if err != nil {
+			return &CompileError{Err: fmt.Errorf("%s: %w, rule: %s", rule.Field, err, rule.Rule)}
+		}
+		tracker := newCostTracker(ctx, v.RuntimeCostLimit)
+		celVars[costTrackerVar] = tracker
+		out, _, err := prg.Eval(celVars)
+		if tracker.err != nil {
+			err = tracker.err
+		}
+		if err != nil {
+			return fmt.Errorf("%s: conversion rule evaluation error: %w", rule.Field, err)
+		}
+		value, err := toUnstructured(out)
+		if err != nil {
+			return fmt.Errorf("%s: conversion rule evaluation error: %w", rule.Field, err)
+		}
+		if value != nil {
+			fieldSchema, err := SchemaAt(target.Schema, rule.Path())
+			if err != nil {
+				return fmt.Errorf("%s: %w", rule.Field, err)
+			}
+			if err := CheckType(fieldSchema, value); err != nil {
+				return fmt.Errorf("%s: %w", rule.Field, err)
+			}
+		}
+		if err := setField(converted, rule.Path(), value); err != nil {
+			return fmt.Errorf("%s: %w", rule.Field, err)
+		}
+	}
+	return nil
+}
+
+// setField sets the field at path, a list of property names, in obj, creating the objects holding it
+// as needed. A nil value removes the field.
+func setField(obj map[string]interface{}, path []string, value interface{}) error {
+	for i, propName := range path[:len(path)-1] {
+		next, ok := obj[propName].(map[string]interface{})
+		if !ok {
+			if obj[propName] != nil {
+				return fmt.Errorf("%s is not an object", strings.Join(path[:i+1], "."))
+			}
+			if value == nil {
+				return nil
+			}
+			next = map[string]interface{}{}
+			obj[propName] = next
+		}
+		obj = next
+	}
+	if value == nil {
+		delete(obj, path[len(path)-1])
+		return nil
+	}
+	obj[path[len(path)-1]] = value
+	return nil
+}
+
+func (v *CelValidator) ValidateDefault(fieldpath []string, propName string, celSource string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) error {
+	_, err := v.defaultProgram(fieldpath, propName, celSource, crd, schema)
+	return err
+}
+
+// Default evaluates the default rule of the property propName against obj, the object holding it.
+// The value is returned in its unstructured form. A rule evaluating to null returns nil, leaving the
+// property unset.
+func (v *CelValidator) Default(ctx context.Context, fieldpath []string, propName string, celSource string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj interface{}) (interface{}, error) {
+	prg, err := v.defaultProgram(fieldpath, propName, celSource, crd, schema)
+	if err != nil {
+		return nil, &CompileError{Err: fmt.Errorf("%w, rule: %s", err, celSource)}
+	}
+	celVars := map[string]interface{}{}
+	v.buildVars(crd.Schema, schema, root, obj, celVars)
+	tracker := newCostTracker(ctx, v.RuntimeCostLimit)
+	celVars[costTrackerVar] = tracker
+	out, _, err := prg.Eval(celVars)
+	if tracker.err != nil {
+		err = tracker.err
+	}
+	if err != nil {
+		klog.V(2).Infof("default rule evaluation error: %v for: %#+v, rule: %s", err, obj, celSource)
+		return nil, fmt.Errorf("default rule evaluation error: %w", err)
+	}
+	value, err := toUnstructured(out)
+	if err != nil {
+		return nil, fmt.Errorf("default rule result error: %w", err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	prop := schema.Properties[propName]
+	if err := CheckType(&prop, value); err != nil {
+		return nil, fmt.Errorf("default rule result error: %w", err)
+	}
+	return value, nil
+}
+
+// isReservedVar reports whether name is one of the variables bound by every rule, which take
+// precedence over properties of the same name.
+func isReservedVar(name string) bool {
+	return name == SelfVar || name == OldSelfVar || name == RootVar
+}
+
+// referencesIdent reports whether e or any of its subexpressions references the identifier name.
+func referencesIdent(e *expr.Expr, name string) bool {
+	if e == nil {
+		return false
+	}
+	switch k := e.ExprKind.(type) {
+	case *expr.Expr_IdentExpr:
+		return k.IdentExpr.GetName() == name
+	case *expr.Expr_SelectExpr:
+		return referencesIdent(k.SelectExpr.GetOperand(), name)
+	case *expr.Expr_CallExpr:
+		if referencesIdent(k.CallExpr.GetTarget(), name) {
+			return true
+		}
+		for _, arg := range k.CallExpr.GetArgs() {
+			if referencesIdent(arg, name) {
+				return true
+			}
+		}
+	case *expr.Expr_ListExpr:
+		for _, elem := range k.ListExpr.GetElements() {
+			if referencesIdent(elem, name) {
+				return true
+			}
+		}
+	case *expr.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			if referencesIdent(entry.GetMapKey(), name) || referencesIdent(entry.GetValue(), name) {
+				return true
+			}
+		}
+	case *expr.Expr_ComprehensionExpr:
+		c := k.ComprehensionExpr
+		return referencesIdent(c.GetIterRange(), name) || referencesIdent(c.GetAccuInit(), name) ||
+			referencesIdent(c.GetLoopCondition(), name) || referencesIdent(c.GetLoopStep(), name) ||
+			referencesIdent(c.GetResult(), name)
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package validators
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// ruleTest is a validation rule evaluated against an object.
+type ruleTest struct {
+	rule string
+	// err is a substring of the error expected from the rule, if it is expected to fail.
+	err string
+	// compileErr is set if the rule is expected to fail to compile.
+	compileErr bool
+}
+
+// testRules evaluates each rule against obj, given as JSON, at the root of schema, also given as JSON.
+// Rules are evaluated as transition rules against oldObj, if it is not empty.
+func testRules(t *testing.T, v *CelValidator, schema, obj, oldObj string, tests []ruleTest) {
+	t.Helper()
+	s := &apiextensionsv1.JSONSchemaProps{}
+	if err := utiljson.Unmarshal([]byte(schema), s); err != nil {
+		t.Fatal(err)
+	}
+	crd := CRDVersion{UID: "uid", Generation: 1, Version: "v1", Schema: s}
+	var o, old interface{}
+	if err := utiljson.Unmarshal([]byte(obj), &o); err != nil {
+		t.Fatal(err)
+	}
+	if oldObj != "" {
+		if err := utiljson.Unmarshal([]byte(oldObj), &old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range tests {
+		t.Run(tc.rule, func(t *testing.T) {
+			err := v.ValidateProgram(nil, ValidationRule{Rule: tc.rule}, crd, s)
+			if tc.compileErr {
+				if err == nil {
+					t.Fatalf("expected rule to fail to compile")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected compile error: %v", err)
+			}
+			err = v.Validate(nil, ValidationRule{Rule: tc.rule}, crd, s, o, o, old)
+			var compileErr *CompileError
+			switch {
+			case errors.As(err, &compileErr):
+				t.Errorf("unexpected compile error: %v", err)
+			case tc.err == "" && err != nil:
+				t.Errorf("expected rule to pass, got %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestArrayItems(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{
+			"names":{"type":"array","maxItems":10,"items":{"type":"string","maxLength":10}},
+			"ports":{"type":"array","maxItems":10,"items":{"type":"integer"}},
+			"matrix":{"type":"array","items":{"type":"array","items":{"type":"number"}}}}}`,
+		`{"names":["a","ab"],"ports":[80,443],"matrix":[[1.5],[2.5,3.5]]}`, "",
+		[]ruleTest{
+			{rule: "self.names.all(n, n.startsWith('a'))"},
+			{rule: "self.names[1].size() == 2"},
+			{rule: "self.ports.exists(p, p == 443) && self.ports.all(p, p > 0)"},
+			{rule: "self.matrix[1][1] == 3.5"},
+			{rule: "self.names.all(n, n.startsWith('b'))", err: "failed validation rule"},
+			{rule: "self.names.all(n, n > 1)", compileErr: true},
+			{rule: "self.ports[0].startsWith('8')", compileErr: true},
+		})
+}
+
+func TestNestedObjects(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{
+			"spec":{"type":"object","properties":{
+				"replicas":{"type":"integer"},
+				"template":{"type":"object","properties":{"name":{"type":"string"},"ratio":{"type":"number"}}}}}}}`,
+		`{"spec":{"replicas":2,"template":{"name":"t","ratio":0.5}}}`, "",
+		[]ruleTest{
+			{rule: "self.spec.replicas == 2"},
+			{rule: "self.spec.template.name == 't' && self.spec.template.ratio < 1.0"},
+			{rule: "has(self.spec.template) && !has(self.spec.template.missing)", compileErr: true},
+			{rule: "has(self.spec.template.name)"},
+			{rule: "self.spec.template.name == 'u'", err: "failed validation rule"},
+			{rule: "self.spec.replicas == 'two'", compileErr: true},
+			{rule: "self.spec.template.name.size() > self.spec.replicas.size()", compileErr: true},
+		})
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"spec":{"type":"object","properties":{"template":{"type":"object","properties":{"name":{"type":"string"}}}}}}}`,
+		`{"spec":{}}`, "",
+		[]ruleTest{
+			{rule: "!has(self.spec.template)"},
+			{rule: "self.spec.template.name == 't'", err: "evaluation error"},
+		})
+}
+
+func TestEscapedPropertyNames(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"spec":{"type":"object","properties":{
+			"in":{"type":"integer"},
+			"namespace":{"type":"string"},
+			"max-replicas":{"type":"integer"},
+			"app.kubernetes.io/name":{"type":"string"},
+			"a__b":{"type":"integer"},
+			"a_b":{"type":"integer"},
+			"1st":{"type":"integer"}}}}}`,
+		`{"spec":{"in":1,"namespace":"ns","max-replicas":3,"app.kubernetes.io/name":"web","a__b":4,"a_b":5,"1st":6}}`, "",
+		[]ruleTest{
+			{rule: "self.spec.__in__ == 1 && self.spec.__namespace__ == 'ns'"},
+			{rule: "self.spec.max__dash__replicas == 3"},
+			{rule: "self.spec.app__dot__kubernetes__dot__io__slash__name == 'web'"},
+			{rule: "self.spec.a__underscores__b == 4 && self.spec.a_b == 5"},
+			{rule: "has(self.spec.__in__) && has(self.spec.max__dash__replicas)"},
+			{rule: "self.spec.max__dash__replicas < 3", err: "failed validation rule"},
+			// Unescaped names collide with keywords and operators, so they are rejected.
+			{rule: "self.spec.in == 1", compileErr: true},
+			{rule: "self.spec.max-replicas == 3", compileErr: true},
+			{rule: "self.spec.a__b == 4", compileErr: true},
+			// Names that cannot be escaped to an identifier are not accessible.
+			{rule: "has(self.spec.__1st__)", compileErr: true},
+		})
+}
+
+func TestAdditionalProperties(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{
+			"labels":{"type":"object","maxProperties":10,"additionalProperties":{"type":"string","maxLength":10}},
+			"limits":{"type":"object","maxProperties":10,"additionalProperties":{"type":"object","properties":{"max":{"type":"integer"}}}}}}`,
+		`{"labels":{"app":"web","tier":"front"},"limits":{"cpu":{"max":2},"memory":{"max":4}}}`, "",
+		[]ruleTest{
+			{rule: "self.labels['app'] == 'web'"},
+			{rule: "'tier' in self.labels && !('zone' in self.labels)"},
+			{rule: "self.labels.all(k, self.labels[k].size() > 2)"},
+			{rule: "self.limits['memory'].max > self.limits['cpu'].max"},
+			{rule: "self.limits.all(k, self.limits[k].max < 4)", err: "failed validation rule"},
+			{rule: "self.labels['app'] > 1", compileErr: true},
+			{rule: "self.limits['cpu'].missing == 1", compileErr: true},
+		})
+}
+
+func TestProgramCache(t *testing.T) {
+	s := &apiextensionsv1.JSONSchemaProps{Type: "object", Properties: map[string]apiextensionsv1.JSONSchemaProps{"a": {Type: "integer"}}}
+	crd := func(uid types.UID, generation int64) *apiextensionsv1.CustomResourceDefinition {
+		return &apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{UID: uid, Generation: generation}}
+	}
+	rule := ValidationRule{Rule: "self.a > 0"}
+	v := NewCelValidator()
+	cached := func() int {
+		v.lock.RLock()
+		defer v.lock.RUnlock()
+		return len(v.compiledPrograms)
+	}
+
+	if err := v.ValidateProgram(nil, rule, CRDVersion{Version: "v1", Schema: s}, s); err != nil || cached() != 0 {
+		t.Fatalf("expected programs without a UID not to be cached, got %d cached, err %v", cached(), err)
+	}
+	if err := v.ValidateProgram(nil, rule, CRDVersion{UID: "a", Generation: 1, Version: "v1", Schema: s}, s); err != nil || cached() != 0 {
+		t.Fatalf("expected programs of unregistered CRDs not to be cached, got %d cached, err %v", cached(), err)
+	}
+
+	v.RegisterCustomResourceDefinition(crd("a", 1))
+	v.RegisterCustomResourceDefinition(crd("b", 1))
+	for _, c := range []CRDVersion{{UID: "a", Generation: 1}, {UID: "b", Generation: 1}} {
+		c.Version, c.Schema = "v1", s
+		if err := v.ValidateProgram(nil, rule, c, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.ValidateProgram(nil, ValidationRule{Rule: "self.a > 'x'"}, c, s); err == nil {
+			t.Fatal("expected compile error")
+		}
+	}
+	if cached() != 4 {
+		t.Fatalf("expected programs and compile errors of registered CRDs to be cached, got %d", cached())
+	}
+	a1 := v.compiledPrograms[programKey{uid: "a", generation: 1, version: "v1", path: "/", rule: rule.Rule}]
+	if err := v.ValidateProgram(nil, rule, CRDVersion{UID: "a", Generation: 1, Version: "v1", Schema: s}, s); err != nil || cached() != 4 ||
+		v.compiledPrograms[programKey{uid: "a", generation: 1, version: "v1", path: "/", rule: rule.Rule}].program != a1.program {
+		t.Fatalf("expected cached program to be reused")
+	}
+
+	v.RegisterCustomResourceDefinition(crd("a", 2))
+	if cached() != 2 {
+		t.Fatalf("expected programs of previous generations to be invalidated, got %d cached", cached())
+	}
+	if err := v.ValidateProgram(nil, rule, CRDVersion{UID: "a", Generation: 1, Version: "v1", Schema: s}, s); err != nil || cached() != 2 {
+		t.Fatalf("expected programs of previous generations not to be cached, got %d cached, err %v", cached(), err)
+	}
+
+	v.UnregisterCustomResourceDefinition(crd("b", 1))
+	if cached() != 0 {
+		t.Fatalf("expected programs of unregistered CRDs to be invalidated, got %d cached", cached())
+	}
+}
+
+func TestValidateContextDeadline(t *testing.T) {
+	s := &apiextensionsv1.JSONSchemaProps{Type: "object", Properties: map[string]apiextensionsv1.JSONSchemaProps{
+		"a": {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{Type: "integer"}}}}}
+	var items []interface{}
+	for i := 0; i < 3000; i++ {
+		items = append(items, int64(i))
+	}
+	obj := map[string]interface{}{"a": items}
+	v := NewCelValidator()
+	v.StaticCostBudget = 0
+	v.RuntimeCostLimit = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := v.ValidateContext(ctx, nil, ValidationRule{Rule: "self.a.all(x, self.a.all(y, x != y || x == y))"}, CRDVersion{Version: "v1", Schema: s}, s, obj, obj, nil)
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected evaluation to stop at the deadline, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected evaluation to stop at the deadline, took %v", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := v.ValidateContext(cancelled, nil, ValidationRule{Rule: "true"}, CRDVersion{Version: "v1", Schema: s}, s, obj, obj, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected evaluation with a cancelled context to fail, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package validators
+
+import (
+	"fmt"
+
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// constantArgCheck validates an argument of a function when it is a constant string.
+type constantArgCheck struct {
+	// arg is the index of the argument, not counting the receiver of member functions.
+	arg   int
+	check func(string) error
+}
+
+// constantArgChecks are the checks of the arguments of functions that parse patterns or values,
+// keyed by function name. Constant arguments are checked when rules are compiled, so that invalid
+// values are reported when the CRD is registered instead of failing every evaluation.
+var constantArgChecks = map[string]constantArgCheck{
+	"find":    {arg: 0, check: checkRegex},
+	"findAll": {arg: 0, check: checkRegex},
+	"url":     {arg: 0, check: checkURL},
+	"ip":      {arg: 0, check: checkIP},
+	"cidr":    {arg: 0, check: checkCIDR},
+	// The CIDR functions also accept addresses and CIDRs as strings.
+	"containsIP":   {arg: 0, check: checkIP},
+	"containsCIDR": {arg: 0, check: checkCIDR},
+	"overlaps":     {arg: 0, check: checkCIDR},
+	"cron":         {arg: 0, check: checkCron},
+	"semver":       {arg: 0, check: checkSemver},
+	"inRange":      {arg: 0, check: checkSemverRange},
+}
+
+// checkConstantArgs runs the constantArgChecks of all calls in e with constant arguments.
+func checkConstantArgs(e *expr.Expr) error {
+	switch e.ExprKind.(type) {
+	case *expr.Expr_SelectExpr:
+		return checkConstantArgs(e.GetSelectExpr().GetOperand())
+	case *expr.Expr_CallExpr:
+		call := e.GetCallExpr()
+		if c, ok := constantArgChecks[call.GetFunction()]; ok && c.arg < len(call.GetArgs()) {
+			if s, ok := call.GetArgs()[c.arg].GetConstExpr().GetConstantKind().(*expr.Constant_StringValue); ok {
+				if err := c.check(s.StringValue); err != nil {
+					return fmt.Errorf("invalid argument to %s: %w", call.GetFunction(), err)
+				}
+			}
+		}
+		if call.GetTarget() != nil {
+			if err := checkConstantArgs(call.GetTarget()); err != nil {
+				return err
+			}
+		}
+		for _, arg := range call.GetArgs() {
+			if err := checkConstantArgs(arg); err != nil {
+				return err
+			}
+		}
+	case *expr.Expr_ListExpr:
+		for _, elem := range e.GetListExpr().GetElements() {
+			if err := checkConstantArgs(elem); err != nil {
+				return err
+			}
+		}
+	case *expr.Expr_StructExpr:
+		for _, entry := range e.GetStructExpr().GetEntries() {
+			if entry.GetMapKey() != nil {
+				if err := checkConstantArgs(entry.GetMapKey()); err != nil {
+					return err
+				}
+			}
+			if err := checkConstantArgs(entry.GetValue()); err != nil {
+				return err
+			}
+		}
+	case *expr.Expr_ComprehensionExpr:
+		comp := e.GetComprehensionExpr()
+		for _, sub := range []*expr.Expr{comp.GetIterRange(), comp.GetAccuInit(), comp.GetLoopCondition(), comp.GetLoopStep(), comp.GetResult()} {
+			if err := checkConstantArgs(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package validators
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+const (
+	// DefaultStaticCostBudget is the default maximum estimated worst case cost of a rule.
+	DefaultStaticCostBudget = 10000000
+	// DefaultRuntimeCostLimit is the default maximum cost of the rule evaluations of a request.
+	DefaultRuntimeCostLimit = 1000000
+
+	// maxRequestSizeBytes is the maximum size of an object accepted by the apiserver. It bounds the
+	// size of strings, lists and maps whose schema does not declare a maximum.
+	maxRequestSizeBytes = 3 * 1024 * 1024
+	// minItemSizeBytes is the size of the smallest serialized list item or map entry, e.g. "0,".
+	minItemSizeBytes = 2
+
+	// contextCheckInterval is the number of evaluation steps between checks for the cancellation of
+	// the evaluation context.
+	contextCheckInterval = 100
+
+	// costTrackerVar is the activation variable holding the costTracker of an evaluation. It is not a
+	// valid CEL identifier, so rules cannot refer to it.
+	costTrackerVar = "#costTracker"
+)
+
+// runtimeCostBudget holds the cost spent by the rule evaluations sharing it.
+type runtimeCostBudget struct {
+	spent int64
+	// err is set once an evaluation charged to the budget exceeds its limit.
+	err error
+}
+
+type runtimeCostBudgetKey struct{}
+
+// WithRuntimeCostBudget returns a copy of ctx holding a new runtime cost budget, which the rule
+// evaluations given the returned context share, so that the runtime cost limit bounds all of them
+// together rather than each. A request's context should hold a single budget, used by evaluations
+// that do not run concurrently. Evaluations given a context without a budget are each limited on
+// their own.
+func WithRuntimeCostBudget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, runtimeCostBudgetKey{}, &runtimeCostBudget{})
+}
+
+// RuntimeCostBudgetErr returns an error naming the runtime cost limit once it has been exceeded by
+// the rule evaluations sharing the budget held by ctx, or nil otherwise. Every later evaluation
+// given ctx fails, so, as when ctx is done, callers should stop evaluating rules.
+func RuntimeCostBudgetErr(ctx context.Context) error {
+	if budget, ok := ctx.Value(runtimeCostBudgetKey{}).(*runtimeCostBudget); ok {
+		return budget.err
+	}
+	return nil
+}
+
+// costTracker counts the cost of an evaluation and stops it once the limit is exceeded by the
+// budget the evaluation is charged to, or its context is done.
+type costTracker struct {
+	ctx    context.Context
+	limit  int64
+	budget *runtimeCostBudget
+	// err is set once the evaluation must stop.
+	err error
+}
+
+func newCostTracker(ctx context.Context, limit int64) *costTracker {
+	budget, ok := ctx.Value(runtimeCostBudgetKey{}).(*runtimeCostBudget)
+	if !ok {
+		budget = &runtimeCostBudget{}
+	}
+	t := &costTracker{ctx: ctx, limit: limit, budget: budget}
+	t.checkLimit()
+	if t.err == nil {
+		t.checkContext()
+	}
+	return t
+}
+
+// add charges cost to the evaluation, returning false if it must stop.
+func (t *costTracker) add(cost int64) bool {
+	if t.err != nil {
+		return false
+	}
+	t.budget.spent += cost
+	t.checkLimit()
+	if t.err == nil && t.budget.spent%contextCheckInterval == 0 {
+		t.checkContext()
+	}
+	return t.err == nil
+}
+
+func (t *costTracker) checkLimit() {
+	if t.limit > 0 && t.budget.spent > t.limit {
+		t.err = fmt.Errorf("evaluation cost exceeded the limit of %d", t.limit)
+		if t.budget.err == nil {
+			t.budget.err = t.err
+		}
+	}
+}
+
+func (t *costTracker) checkContext() {
+	if err := t.ctx.Err(); err != nil {
+		t.err = fmt.Errorf("evaluation interrupted: %w", err)
+	}
+}
+
+// decorateCost charges a unit of cost for each evaluation of a call, comprehension step, operator or
+// literal, so that evaluation stops once the costTracker bound to the activation runs out or its
+// context is done. As for
+// cel-go's own evaluation observers, attributes and constants are left undecorated so that the
+// planner can still combine and fold them; they are charged through the calls that use them.
+func decorateCost(i interpreter.Interpretable) (interpreter.Interpretable, error) {
+	switch i.(type) {
+	case *costInterpretable, interpreter.InterpretableAttribute, interpreter.InterpretableConst:
+		return i, nil
+	default:
+		return &costInterpretable{Interpretable: i}, nil
+	}
+}
+
+type costInterpretable struct {
+	interpreter.Interpretable
+}
+
+// Eval implements the interpreter.Interpretable interface method.
+func (c *costInterpretable) Eval(activation interpreter.Activation) ref.Val {
+	if v, ok := activation.ResolveName(costTrackerVar); ok {
+		if t, ok := v.(*costTracker); ok && !t.add(1) {
+			return types.NewErr(t.err.Error())
+		}
+	}
+	return c.Interpretable.Eval(activation)
+}
+
+// estimateCost returns the worst case cost of evaluating e, a checked rule of the schema node schema,
+// against objects matching the schema. The cost is in the evaluation steps charged by decorateCost,
+// except that functions scanning strings are charged for each byte since their running time depends
+// on the length of the string. The size of lists, maps and strings is bounded by the maxItems,
+// maxProperties and maxLength of their schema, or by the maximum request size if they have none.
+func estimateCost(e *expr.Expr, rootSchema, schema *apiextensionsv1.JSONSchemaProps) int64 {
+	vars := map[string]*apiextensionsv1.JSONSchemaProps{
+		SelfVar:    schema,
+		OldSelfVar: schema,
+		RootVar:    rootSchema,
+	}
+	if schema.Type == "object" {
+		for propName, prop := range schema.Properties {
+			if fieldName, ok := escapeName(propName); ok && !isReservedVar(fieldName) {
+				prop := prop
+				vars[fieldName] = &prop
+			}
+		}
+	}
+	cost, _ := estimate(e, vars)
+	return cost
+}
+
+// estimate returns the worst case cost of e and the schema of its value, if known. vars holds the
+// schema of the variables in scope.
+func estimate(e *expr.Expr, vars map[string]*apiextensionsv1.JSONSchemaProps) (int64, *apiextensionsv1.JSONSchemaProps) {
+	switch e.ExprKind.(type) {
+	case *expr.Expr_ConstExpr:
+		return 0, nil
+	case *expr.Expr_IdentExpr:
+		return 0, vars[e.GetIdentExpr().GetName()]
+	case *expr.Expr_SelectExpr:
+		sel := e.GetSelectExpr()
+		cost, operand := estimate(sel.GetOperand(), vars)
+		if sel.GetTestOnly() {
+			return cost, nil
+		}
+		return cost, propertySchema(operand, sel.GetField())
+	case *expr.Expr_CallExpr:
+		return estimateCall(e.GetCallExpr(), vars)
+	case *expr.Expr_ListExpr:
+		cost := int64(1)
+		for _, elem := range e.GetListExpr().GetElements() {
+			elemCost, _ := estimate(elem, vars)
+			cost = addCost(cost, elemCost)
+		}
+		return cost, nil
+	case *expr.Expr_StructExpr:
+		cost := int64(1)
+		for _, entry := range e.GetStructExpr().GetEntries() {
+			keyCost, _ := estimate(entry.GetMapKey(), vars)
+			valueCost, _ := estimate(entry.GetValue(), vars)
+			cost = addCost(cost, addCost(keyCost, valueCost))
+		}
+		return cost, nil
+	case *expr.Expr_ComprehensionExpr:
+		comp := e.GetComprehensionExpr()
+		rangeCost, rangeSchema := estimate(comp.GetIterRange(), vars)
+		loopVars := make(map[string]*apiextensionsv1.JSONSchemaProps, len(vars)+2)
+		for name, s := range vars {
+			loopVars[name] = s
+		}
+		// Comprehensions over maps iterate over their keys, which have no schema.
+		loopVars[comp.GetIterVar()] = nil
+		if rangeSchema != nil && rangeSchema.Type == "array" {
+			loopVars[comp.GetIterVar()] = elementSchema(rangeSchema)
+		}
+		delete(loopVars, comp.GetAccuVar())
+		initCost, _ := estimate(comp.GetAccuInit(), vars)
+		condCost, _ := estimate(comp.GetLoopCondition(), loopVars)
+		stepCost, _ := estimate(comp.GetLoopStep(), loopVars)
+		resultCost, _ := estimate(comp.GetResult(), loopVars)
+		iterations := maxSize(rangeSchema)
+		cost := addCost(1, addCost(rangeCost, addCost(initCost, resultCost)))
+		return addCost(cost, mulCost(iterations, addCost(condCost, stepCost))), nil
+	}
+	return 1, nil
+}
+
+func estimateCall(call *expr.Expr_Call, vars map[string]*apiextensionsv1.JSONSchemaProps) (int64, *apiextensionsv1.JSONSchemaProps) {
+	cost := int64(1)
+	var target *apiextensionsv1.JSONSchemaProps
+	if call.GetTarget() != nil {
+		var targetCost int64
+		targetCost, target = estimate(call.GetTarget(), vars)
+		cost = addCost(cost, targetCost)
+	}
+	args := make([]*apiextensionsv1.JSONSchemaProps, len(call.GetArgs()))
+	for i, arg := range call.GetArgs() {
+		var argCost int64
+		argCost, args[i] = estimate(arg, vars)
+		cost = addCost(cost, argCost)
+	}
+	switch call.GetFunction() {
+	case "_[_]":
+		if len(args) == 2 {
+			return cost, elementSchema(args[0])
+		}
+	case "@in":
+		// Membership in a list is a linear scan.
+		if len(args) == 2 && args[1] != nil && args[1].Type == "array" {
+			return addCost(cost, maxSize(args[1])), nil
+		}
+	case "contains", "startsWith", "endsWith", "matches", "indexOf", "lastIndexOf", "replace", "split",
+		"lowerAscii", "upperAscii", "trim", "substring", "base64.encode", "base64.decode", "find", "findAll":
+		// String functions are linear in the length of the string they operate on.
+		if target == nil && len(args) > 0 {
+			target = args[0]
+		}
+		return addCost(cost, maxSize(target)), nil
+	}
+	return cost, nil
+}
+
+// propertySchema returns the schema of the property of an object schema accessed as field, which is
+// the escaped property name, or the schema of its values if it is a map.
+func propertySchema(schema *apiextensionsv1.JSONSchemaProps, field string) *apiextensionsv1.JSONSchemaProps {
+	if schema == nil || schema.Type != "object" {
+		return nil
+	}
+	for propName, prop := range schema.Properties {
+		if fieldName, ok := escapeName(propName); ok && fieldName == field {
+			return &prop
+		}
+	}
+	if schema.AdditionalProperties != nil {
+		return schema.AdditionalProperties.Schema
+	}
+	return nil
+}
+
+// elementSchema returns the schema of the items of a list schema, or of the values of a map schema.
+func elementSchema(schema *apiextensionsv1.JSONSchemaProps) *apiextensionsv1.JSONSchemaProps {
+	if schema == nil {
+		return nil
+	}
+	switch schema.Type {
+	case "array":
+		if schema.Items != nil {
+			return schema.Items.Schema
+		}
+	case "object":
+		if schema.AdditionalProperties != nil {
+			return schema.AdditionalProperties.Schema
+		}
+	}
+	return nil
+}
+
+// maxSize returns the maximum number of items of a list, entries of a map or bytes of a string
+// matching schema.
+func maxSize(schema *apiextensionsv1.JSONSchemaProps) int64 {
+	if schema != nil {
+		switch {
+		case schema.Type == "array" && schema.MaxItems != nil:
+			return *schema.MaxItems
+		case schema.Type == "object" && schema.MaxProperties != nil:
+			return *schema.MaxProperties
+		case schema.Type == "string" && schema.MaxLength != nil:
+			return *schema.MaxLength
+		case schema.Type == "string":
+			return maxRequestSizeBytes
+		}
+	}
+	return maxRequestSizeBytes / minItemSizeBytes
+}
+
+// addCost adds costs, saturating at math.MaxInt64.
+func addCost(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// mulCost multiplies costs, saturating at math.MaxInt64.
+func mulCost(a, b int64) int64 {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
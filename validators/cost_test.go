@@ -0,0 +1,96 @@
+package validators
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+const costTestSchema = `{"type":"object","properties":{
+	"unbounded":{"type":"array","items":{"type":"string"}},
+	"bounded":{"type":"array","maxItems":10,"items":{"type":"string","maxLength":5}},
+	"s":{"type":"string"}}}`
+
+func TestStaticCostBudget(t *testing.T) {
+	testRules(t, NewCelValidator(), costTestSchema, `{"unbounded":["a"],"bounded":["a"],"s":"a"}`, "",
+		[]ruleTest{
+			{rule: "self.s.contains('a')"},
+			{rule: "self.bounded.all(x, self.bounded.all(y, x == y))"},
+			{rule: "self.bounded.all(x, x.contains('a'))"},
+			{rule: "self.unbounded.all(x, self.unbounded.all(y, x == y))", compileErr: true},
+			{rule: "self.unbounded.all(x, x.contains('a'))", compileErr: true},
+		})
+
+	v := NewCelValidator()
+	v.StaticCostBudget = 0
+	testRules(t, v, costTestSchema, `{"unbounded":["a"]}`, "",
+		[]ruleTest{
+			{rule: "self.unbounded.all(x, self.unbounded.all(y, x == y))"},
+		})
+}
+
+func TestRuntimeCostLimit(t *testing.T) {
+	obj := `{"unbounded":["a","a","a","a","a","a","a","a","a","a","a"]}`
+	v := NewCelValidator()
+	v.StaticCostBudget = 0
+	v.RuntimeCostLimit = 50
+	testRules(t, v, costTestSchema, obj, "",
+		[]ruleTest{
+			{rule: "self.unbounded.size() == 11"},
+			{rule: "self.unbounded.all(x, self.unbounded.all(y, x == y))", err: "evaluation cost exceeded the limit of 50"},
+			// Errors absorbed by logical operators must still stop the evaluation.
+			{rule: "self.unbounded.all(x, self.unbounded.all(y, x == y)) || true", err: "evaluation cost exceeded the limit of 50"},
+		})
+
+	v = NewCelValidator()
+	v.StaticCostBudget = 0
+	v.RuntimeCostLimit = 0
+	testRules(t, v, costTestSchema, obj, "",
+		[]ruleTest{
+			{rule: "self.unbounded.all(x, self.unbounded.all(y, x == y))"},
+		})
+}
+
+func TestRuntimeCostBudget(t *testing.T) {
+	s := &apiextensionsv1.JSONSchemaProps{}
+	if err := utiljson.Unmarshal([]byte(costTestSchema), s); err != nil {
+		t.Fatal(err)
+	}
+	var obj interface{}
+	if err := utiljson.Unmarshal([]byte(`{"unbounded":["a","a","a","a","a","a","a","a","a","a","a"]}`), &obj); err != nil {
+		t.Fatal(err)
+	}
+	crd := CRDVersion{UID: "uid", Generation: 1, Version: "v1", Schema: s}
+	v := NewCelValidator()
+	v.StaticCostBudget = 0
+	v.RuntimeCostLimit = 50
+	// Each evaluation of the rule costs 34, so only one fits within the limit.
+	rule := ValidationRule{Rule: "self.unbounded.all(x, x == 'a')"}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := v.ValidateContext(ctx, nil, rule, crd, s, obj, obj, nil); err != nil {
+			t.Errorf("expected evaluations without a budget to be limited on their own, got %v", err)
+		}
+	}
+
+	ctx = WithRuntimeCostBudget(context.Background())
+	if err := v.ValidateContext(ctx, nil, rule, crd, s, obj, obj, nil); err != nil {
+		t.Fatalf("expected the first evaluation to stay within the budget, got %v", err)
+	}
+	if err := RuntimeCostBudgetErr(ctx); err != nil {
+		t.Errorf("expected the budget not to be exceeded yet, got %v", err)
+	}
+	if err := v.ValidateContext(ctx, nil, rule, crd, s, obj, obj, nil); err == nil || !strings.Contains(err.Error(), "evaluation cost exceeded the limit of 50") {
+		t.Errorf("expected the second evaluation to exceed the budget, got %v", err)
+	}
+	if err := RuntimeCostBudgetErr(ctx); err == nil || err.Error() != "evaluation cost exceeded the limit of 50" {
+		t.Errorf("expected the budget to report the exceeded limit, got %v", err)
+	}
+	if _, err := v.Default(ctx, nil, "s", "self.unbounded[0]", crd, s, obj, obj); err == nil || !strings.Contains(err.Error(), "evaluation cost exceeded the limit of 50") {
+		t.Errorf("expected default rules to be charged to the same budget, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package validators
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	"github.com/robfig/cron/v3"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Crons returns a cel.EnvOption declaring the kubernetes.Cron type, parsed from cron expressions with
+// the same syntax as the schedule of a CronJob, and the functions that operate on it. Expressions
+// have five fields, minute, hour, day of month, month and day of week, or are one of the descriptors
+// @yearly, @annually, @monthly, @weekly, @daily, @midnight, @hourly and @every <duration>. Constant
+// arguments to cron are checked when rules are compiled.
+//
+//	cron(<string>) -> <kubernetes.Cron>
+//	isCron(<string>) -> <bool>
+//	<kubernetes.Cron>.next(<timestamp>) -> <timestamp>
+//
+// next returns the first time the schedule fires after the given time, and an error if it never
+// does, as for '0 0 30 2 *'.
+//
+// Examples:
+//
+//	isCron(self.cronSpec)
+//	cron('@hourly').next(timestamp('2021-01-01T00:30:00Z')) == timestamp('2021-01-01T01:00:00Z')
+func Crons() cel.EnvOption {
+	return cel.Lib(cronLib{})
+}
+
+// CronType is the CEL type of Cron values.
+var CronType = types.NewTypeValue("kubernetes.Cron")
+
+var cronDeclType = decls.NewAbstractType(CronType.TypeName())
+
+// Cron is the CEL value of a parsed cron expression.
+type Cron struct {
+	cron.Schedule
+	// Spec is the cron expression the schedule was parsed from.
+	Spec string
+}
+
+// ConvertToNative implements the ref.Val interface method.
+func (c Cron) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	if typeDesc.Kind() == reflect.String {
+		return c.Spec, nil
+	}
+	if reflect.TypeOf(c.Schedule).AssignableTo(typeDesc) {
+		return c.Schedule, nil
+	}
+	return nil, fmt.Errorf("type conversion error from '%s' to '%v'", CronType.TypeName(), typeDesc)
+}
+
+// ConvertToType implements the ref.Val interface method.
+func (c Cron) ConvertToType(typeVal ref.Type) ref.Val {
+	switch typeVal {
+	case CronType:
+		return c
+	case types.StringType:
+		return types.String(c.Spec)
+	case types.TypeType:
+		return CronType
+	}
+	return types.NewErr("type conversion error from '%s' to '%s'", CronType.TypeName(), typeVal.TypeName())
+}
+
+// Equal implements the ref.Val interface method.
+func (c Cron) Equal(other ref.Val) ref.Val {
+	o, ok := other.(Cron)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Bool(c.Spec == o.Spec)
+}
+
+// Type implements the ref.Val interface method.
+func (c Cron) Type() ref.Type {
+	return CronType
+}
+
+// Value implements the ref.Val interface method.
+func (c Cron) Value() interface{} {
+	return c.Schedule
+}
+
+type cronLib struct{}
+
+func (cronLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.Declarations(
+			decls.NewFunction("cron",
+				decls.NewOverload("cron_string", []*expr.Type{decls.String}, cronDeclType)),
+			decls.NewFunction("isCron",
+				decls.NewOverload("isCron_string", []*expr.Type{decls.String}, decls.Bool)),
+			decls.NewFunction("next",
+				decls.NewInstanceOverload("cron_next_timestamp", []*expr.Type{cronDeclType, decls.Timestamp}, decls.Timestamp)),
+		),
+	}
+}
+
+func (cronLib) ProgramOptions() []cel.ProgramOption {
+	return []cel.ProgramOption{
+		cel.Functions(
+			&functions.Overload{Operator: "cron", Unary: parseCron},
+			&functions.Overload{Operator: "isCron", Unary: isCron},
+			&functions.Overload{Operator: "next", Binary: cronNext},
+		),
+	}
+}
+
+func parseCron(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	schedule, err := cron.ParseStandard(string(s))
+	if err != nil {
+		return types.NewErr("invalid cron expression %q: %v", string(s), err)
+	}
+	return Cron{Schedule: schedule, Spec: string(s)}
+}
+
+func isCron(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	return types.Bool(checkCron(string(s)) == nil)
+}
+
+func cronNext(lhs, rhs ref.Val) ref.Val {
+	c, ok := lhs.(Cron)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(lhs)
+	}
+	t, ok := rhs.(types.Timestamp)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(rhs)
+	}
+	next := c.Schedule.Next(t.Time)
+	if next.IsZero() {
+		return types.NewErr("cron expression %q never fires after %s", c.Spec, t.Time.Format(time.RFC3339))
+	}
+	return types.Timestamp{Time: next}
+}
+
+func checkCron(spec string) error {
+	_, err := cron.ParseStandard(spec)
+	return err
+}
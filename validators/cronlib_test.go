@@ -0,0 +1,20 @@
+package validators
+
+import "testing"
+
+func TestCron(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"schedule":{"type":"string"},"bad":{"type":"string"}}}`,
+		`{"schedule":"*/5 * * * *","bad":"* * * *"}`, "",
+		[]ruleTest{
+			{rule: "isCron(self.schedule) && isCron('@hourly') && isCron('@every 1h')"},
+			{rule: "!isCron(self.bad) && !isCron('61 * * * *')"},
+			{rule: "cron(self.schedule).next(timestamp('2021-01-01T00:01:00Z')) == timestamp('2021-01-01T00:05:00Z')"},
+			{rule: "cron('@hourly').next(timestamp('2021-01-01T00:30:00Z')) == timestamp('2021-01-01T01:00:00Z')"},
+			{rule: "cron(self.schedule) == cron('*/5 * * * *') && cron(self.schedule) != cron('@hourly')"},
+			{rule: "isCron(self.bad)", err: "failed validation rule"},
+			{rule: "cron(self.bad) == cron('@hourly')", err: "evaluation error"},
+			{rule: "cron('0 0 30 2 *').next(timestamp('2021-01-01T00:00:00Z')) > timestamp('2021-01-01T00:00:00Z')", err: "evaluation error"},
+			{rule: "cron('bad') == cron('@hourly')", compileErr: true},
+		})
+}
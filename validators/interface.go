@@ -1,14 +1,131 @@
 package validators
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
+// CRDVersion identifies a version of a CustomResourceDefinition and holds its schema. UID is empty
+// for CustomResourceDefinitions that have not been created yet, such as those being admitted.
+type CRDVersion struct {
+	UID        types.UID
+	Generation int64
+	Version    string
+	Schema     *apiextensionsv1.JSONSchemaProps
+}
+
+// ValidationRule is a rule that validates a schema node, as declared by the rules annotation of a
+// CustomResourceDefinition.
+type ValidationRule struct {
+	// Rule is the expression that must evaluate to true for the node to be valid.
+	Rule string `json:"rule"`
+	// Message is returned when the rule fails instead of a generic failure message.
+	Message string `json:"message,omitempty"`
+	// MessageExpression is an expression evaluating to the message returned when the rule fails. It
+	// has access to the same variables as the rule. Message is returned instead if it evaluates to an
+	// error or to an empty string.
+	MessageExpression string `json:"messageExpression,omitempty"`
+	// Reason is the machine readable reason reported when the rule fails, e.g. FieldValueInvalid.
+	Reason string `json:"reason,omitempty"`
+	// FieldPath is the path, relative to the node, of the field reported when the rule fails.
+	FieldPath string `json:"fieldPath,omitempty"`
+}
+
+// DefaultRule is the default of a property, as declared by the rules annotation of a
+// CustomResourceDefinition. It has either a static Value or a Rule computing the value.
+type DefaultRule struct {
+	// Value is the value the property is set to when it is absent.
+	Value *apiextensionsv1.JSON `json:"value,omitempty"`
+	// Rule is an expression evaluating to the value the property is set to when it is absent. It is
+	// bound to the object holding the property.
+	Rule string `json:"rule,omitempty"`
+}
+
+// ConversionRules convert custom resources from one version of their CustomResourceDefinition to
+// another, as declared by the converters of its conversion.
+type ConversionRules struct {
+	FromVersion string `json:"fromVersion"`
+	ToVersion   string `json:"toVersion"`
+	// Rules set fields of the converted object. They are applied in order, after the fields the
+	// versions have in common are converted.
+	Rules []FieldConversionRule `json:"rules"`
+}
+
+// FieldConversionRule sets a field of a converted custom resource.
+type FieldConversionRule struct {
+	// Field is the full path of the field in the converted object, e.g. spec.image.
+	Field string `json:"field"`
+	// Rule is an expression evaluating to the value the field is set to. It is bound to the object
+	// being converted as self. A rule evaluating to null removes the field.
+	Rule string `json:"rule"`
+}
+
+// Path returns the property names of the field, from the root of the object.
+func (r FieldConversionRule) Path() []string {
+	return strings.Split(r.Field, ".")
+}
+
+// CompileError is returned by FormatValidator.Validate when the rule cannot be compiled.
+type CompileError struct {
+	Err error
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("validation rule compile error: %v", e.Err)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// FormatValidator validates the schema nodes of custom resources. The node is identified by its
+// fieldpath and schema, and is validated in the context of the root object and the version of the
+// CustomResourceDefinition it belongs to. On update, oldObj is the value of the same node in the old
+// object, or nil if it has no such value.
 type FormatValidator interface {
-	Validate(fieldpath []string, validatorContent string, schema *apiextensionsv1.JSONSchemaProps, obj interface{}) error
-	ValidateProgram(fieldpath []string, validatorContent string, schema *apiextensionsv1.JSONSchemaProps) error
+	Validate(fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj, oldObj interface{}) error
+	ValidateProgram(fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) error
+}
+
+// ContextFormatValidator is a FormatValidator that stops validating when ctx is done, returning an
+// error wrapping ctx.Err().
+type ContextFormatValidator interface {
+	FormatValidator
+	ValidateContext(ctx context.Context, fieldpath []string, rule ValidationRule, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj, oldObj interface{}) error
 }
 
+// Converter converts the schema nodes of custom resources from the current version to the target
+// version of their CustomResourceDefinition.
 type Converter interface {
-	Convert(fieldpath []string, validatorContent string, currentVersion, targetVersion string, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error)
+	Convert(fieldpath []string, validatorContent string, current, target CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error)
+	ValidateConversion(fieldpath []string, validatorContent string, current, target CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps) error
+}
+
+// ContextConverter is a Converter that stops converting when ctx is done, returning an error wrapping
+// ctx.Err().
+type ContextConverter interface {
+	Converter
+	ConvertContext(ctx context.Context, fieldpath []string, validatorContent string, current, target CRDVersion, currentSchema, targetSchema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, error)
+}
+
+// ObjectConverter converts whole custom resources between versions of their CustomResourceDefinition
+// with the conversion rules declared at its root. current and target hold the root schemas of the
+// versions converted from and to.
+type ObjectConverter interface {
+	// ConvertObject applies rules to converted, the object obj converted to the target version with
+	// the fields they have in common. Only converted is modified.
+	ConvertObject(ctx context.Context, rules ConversionRules, current, target CRDVersion, obj, converted map[string]interface{}) error
+	ValidateConversionRule(rule FieldConversionRule, current, target CRDVersion) error
+}
+
+// Defaulter computes the defaults of the properties of custom resource objects. The object holding
+// the property is identified by its fieldpath and schema, and the default is computed in the context
+// of the root object and the version of the CustomResourceDefinition it belongs to.
+type Defaulter interface {
+	Default(ctx context.Context, fieldpath []string, propName string, rule string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps, root, obj interface{}) (interface{}, error)
+	ValidateDefault(fieldpath []string, propName string, rule string, crd CRDVersion, schema *apiextensionsv1.JSONSchemaProps) error
 }
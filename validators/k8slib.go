@@ -0,0 +1,125 @@
+package validators
+
+import (
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// KubernetesValidation returns a cel.EnvOption declaring functions that check values with the same
+// semantics as the validation of the Kubernetes core types.
+//
+//	isDNS1123Label(<string>) -> <bool>
+//	isDNS1123Subdomain(<string>) -> <bool>
+//	isQualifiedName(<string>) -> <bool>
+//	isFullyQualifiedName(<string>) -> <bool>
+//	isValidLabelValue(<string>) -> <bool>
+//	isValidPortNum(<int>) -> <bool>
+//	isValidPortName(<string>) -> <bool>
+//	isValidLabelSelectorRequirement(<object>) -> <bool>
+//
+// isValidLabelSelectorRequirement checks an object with the key, operator and values fields of a
+// metav1.LabelSelectorRequirement.
+//
+// Examples:
+//
+//	isQualifiedName('example.com/name')  // returns true
+//	isDNS1123Label('Name')               // returns false
+//	isValidPortNum(self.port)
+func KubernetesValidation() cel.EnvOption {
+	return cel.Lib(k8sValidationLib{})
+}
+
+type k8sValidationLib struct{}
+
+// stringChecks are the functions that check a string with an apimachinery validation helper.
+var stringChecks = map[string]func(string) []string{
+	"isDNS1123Label":     validation.IsDNS1123Label,
+	"isDNS1123Subdomain": validation.IsDNS1123Subdomain,
+	"isQualifiedName":    validation.IsQualifiedName,
+	"isFullyQualifiedName": func(value string) []string {
+		return errorMessages(validation.IsFullyQualifiedName(nil, value))
+	},
+	"isValidLabelValue": validation.IsValidLabelValue,
+	"isValidPortName":   validation.IsValidPortName,
+}
+
+func (k8sValidationLib) CompileOptions() []cel.EnvOption {
+	var fns []*expr.Decl
+	for name := range stringChecks {
+		fns = append(fns, decls.NewFunction(name, decls.NewOverload(name+"_string", []*expr.Type{decls.String}, decls.Bool)))
+	}
+	fns = append(fns,
+		decls.NewFunction("isValidPortNum",
+			decls.NewOverload("isValidPortNum_int", []*expr.Type{decls.Int}, decls.Bool)),
+		decls.NewFunction("isValidLabelSelectorRequirement",
+			decls.NewOverload("isValidLabelSelectorRequirement_dyn", []*expr.Type{decls.Dyn}, decls.Bool)),
+	)
+	return []cel.EnvOption{cel.Declarations(fns...)}
+}
+
+func (k8sValidationLib) ProgramOptions() []cel.ProgramOption {
+	var overloads []*functions.Overload
+	for name, check := range stringChecks {
+		check := check
+		overloads = append(overloads, &functions.Overload{
+			Operator: name,
+			Unary: func(value ref.Val) ref.Val {
+				s, ok := value.(types.String)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(value)
+				}
+				return types.Bool(len(check(string(s))) == 0)
+			},
+		})
+	}
+	overloads = append(overloads,
+		&functions.Overload{
+			Operator: "isValidPortNum",
+			Unary: func(value ref.Val) ref.Val {
+				i, ok := value.(types.Int)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(value)
+				}
+				return types.Bool(len(validation.IsValidPortNum(int(i))) == 0)
+			},
+		},
+		&functions.Overload{
+			Operator: "isValidLabelSelectorRequirement",
+			Unary:    isValidLabelSelectorRequirement,
+		},
+	)
+	return []cel.ProgramOption{cel.Functions(overloads...)}
+}
+
+var unstructuredType = reflect.TypeOf(map[string]interface{}{})
+
+func isValidLabelSelectorRequirement(value ref.Val) ref.Val {
+	native, err := value.ConvertToNative(unstructuredType)
+	if err != nil {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	var requirement metav1.LabelSelectorRequirement
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(native.(map[string]interface{}), &requirement); err != nil {
+		return types.Bool(false)
+	}
+	return types.Bool(len(metav1validation.ValidateLabelSelectorRequirement(requirement, nil)) == 0)
+}
+
+func errorMessages(errs field.ErrorList) []string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.ErrorBody())
+	}
+	return msgs
+}
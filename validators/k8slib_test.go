@@ -0,0 +1,27 @@
+package validators
+
+import "testing"
+
+func TestKubernetesValidation(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{
+			"key":{"type":"string"},
+			"port":{"type":"integer"},
+			"req":{"type":"object","properties":{"key":{"type":"string"},"operator":{"type":"string"},"values":{"type":"array","maxItems":10,"items":{"type":"string"}}}}}}`,
+		`{"key":"example.com/Name","port":70000,"req":{"key":"a","operator":"In","values":[]}}`, "",
+		[]ruleTest{
+			{rule: "isQualifiedName(self.key) && !isQualifiedName('-a')"},
+			{rule: "isDNS1123Label('name') && !isDNS1123Label('Name') && !isDNS1123Label(self.key)"},
+			{rule: "isDNS1123Subdomain('a.b') && !isDNS1123Subdomain('a_b')"},
+			{rule: "isFullyQualifiedName('a.b.c') && !isFullyQualifiedName('a.b')"},
+			{rule: "isValidLabelValue('') && isValidLabelValue('a-b') && !isValidLabelValue('x y')"},
+			{rule: "isValidPortNum(80) && !isValidPortNum(self.port) && !isValidPortNum(0)"},
+			{rule: "isValidPortName('http') && !isValidPortName('80')"},
+			{rule: "isValidLabelSelectorRequirement({'key': 'a', 'operator': 'Exists'})"},
+			{rule: "isValidLabelSelectorRequirement({'key': 'a', 'operator': 'In', 'values': ['b']})"},
+			{rule: "isValidLabelSelectorRequirement(self.req)", err: "failed validation rule"},
+			{rule: "isValidLabelSelectorRequirement({'key': 'a', 'operator': 'Bad'})", err: "failed validation rule"},
+			{rule: "isQualifiedName(1)", compileErr: true},
+			{rule: "isValidPortNum('80')", compileErr: true},
+		})
+}
@@ -0,0 +1,439 @@
+package validators
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Network returns a cel.EnvOption declaring the kubernetes.URL, kubernetes.IP and kubernetes.CIDR
+// types, parsed from strings, and the functions that operate on them. Constant arguments to url, ip
+// and cidr are checked when rules are compiled.
+//
+//	url(<string>) -> <kubernetes.URL>
+//	isURL(<string>) -> <bool>
+//	<kubernetes.URL>.getScheme() -> <string>
+//	<kubernetes.URL>.getHost() -> <string>
+//	<kubernetes.URL>.getHostname() -> <string>
+//	<kubernetes.URL>.getPort() -> <string>
+//	<kubernetes.URL>.getEscapedPath() -> <string>
+//	<kubernetes.URL>.getQuery() -> <map<string, list<string>>>
+//
+//	ip(<string>) -> <kubernetes.IP>
+//	isIP(<string>) -> <bool>
+//	<kubernetes.IP>.family() -> <int>
+//	<kubernetes.IP>.isLoopback() -> <bool>
+//	<kubernetes.IP>.isUnspecified() -> <bool>
+//
+//	cidr(<string>) -> <kubernetes.CIDR>
+//	isCIDR(<string>) -> <bool>
+//	<kubernetes.CIDR>.ip() -> <kubernetes.IP>
+//	<kubernetes.CIDR>.prefixLength() -> <int>
+//	<kubernetes.CIDR>.containsIP(<kubernetes.IP|string>) -> <bool>
+//	<kubernetes.CIDR>.containsCIDR(<kubernetes.CIDR|string>) -> <bool>
+//	<kubernetes.CIDR>.overlaps(<kubernetes.CIDR|string>) -> <bool>
+//
+// URLs must be absolute URIs or absolute paths, as for url.ParseRequestURI. family returns 4 or 6.
+// The ip of a CIDR is its network address. Addresses and CIDRs of different families never contain
+// or overlap each other.
+//
+// Examples:
+//
+//	url(self.endpoint).getScheme() == 'https'
+//	cidr(self.podCIDR).containsIP(self.gatewayIP)
+//	!self.serviceCIDRs.exists(c, cidr(c).overlaps(self.podCIDR))
+func Network() cel.EnvOption {
+	return cel.Lib(networkLib{})
+}
+
+// URLType is the CEL type of URL values.
+var URLType = types.NewTypeValue("kubernetes.URL")
+
+// IPType is the CEL type of IP values.
+var IPType = types.NewTypeValue("kubernetes.IP")
+
+// CIDRType is the CEL type of CIDR values.
+var CIDRType = types.NewTypeValue("kubernetes.CIDR")
+
+var (
+	urlDeclType  = decls.NewAbstractType(URLType.TypeName())
+	ipDeclType   = decls.NewAbstractType(IPType.TypeName())
+	cidrDeclType = decls.NewAbstractType(CIDRType.TypeName())
+)
+
+// URL is the CEL value of a url.URL.
+type URL struct {
+	*url.URL
+}
+
+// ConvertToNative implements the ref.Val interface method.
+func (u URL) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	if typeDesc == reflect.TypeOf(u.URL) {
+		return u.URL, nil
+	}
+	return nil, fmt.Errorf("type conversion error from '%s' to '%v'", URLType.TypeName(), typeDesc)
+}
+
+// ConvertToType implements the ref.Val interface method.
+func (u URL) ConvertToType(typeVal ref.Type) ref.Val {
+	switch typeVal {
+	case URLType:
+		return u
+	case types.StringType:
+		return types.String(u.URL.String())
+	case types.TypeType:
+		return URLType
+	}
+	return types.NewErr("type conversion error from '%s' to '%s'", URLType.TypeName(), typeVal.TypeName())
+}
+
+// Equal implements the ref.Val interface method.
+func (u URL) Equal(other ref.Val) ref.Val {
+	o, ok := other.(URL)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Bool(u.URL.String() == o.URL.String())
+}
+
+// Type implements the ref.Val interface method.
+func (u URL) Type() ref.Type {
+	return URLType
+}
+
+// Value implements the ref.Val interface method.
+func (u URL) Value() interface{} {
+	return u.URL
+}
+
+// IP is the CEL value of a net.IP.
+type IP struct {
+	net.IP
+}
+
+// ConvertToNative implements the ref.Val interface method.
+func (ip IP) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	if typeDesc == reflect.TypeOf(ip.IP) {
+		return ip.IP, nil
+	}
+	return nil, fmt.Errorf("type conversion error from '%s' to '%v'", IPType.TypeName(), typeDesc)
+}
+
+// ConvertToType implements the ref.Val interface method.
+func (ip IP) ConvertToType(typeVal ref.Type) ref.Val {
+	switch typeVal {
+	case IPType:
+		return ip
+	case types.StringType:
+		return types.String(ip.IP.String())
+	case types.TypeType:
+		return IPType
+	}
+	return types.NewErr("type conversion error from '%s' to '%s'", IPType.TypeName(), typeVal.TypeName())
+}
+
+// Equal implements the ref.Val interface method.
+func (ip IP) Equal(other ref.Val) ref.Val {
+	o, ok := other.(IP)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Bool(ip.IP.Equal(o.IP))
+}
+
+// Type implements the ref.Val interface method.
+func (ip IP) Type() ref.Type {
+	return IPType
+}
+
+// Value implements the ref.Val interface method.
+func (ip IP) Value() interface{} {
+	return ip.IP
+}
+
+// CIDR is the CEL value of a net.IPNet.
+type CIDR struct {
+	*net.IPNet
+}
+
+// ConvertToNative implements the ref.Val interface method.
+func (c CIDR) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	if typeDesc == reflect.TypeOf(c.IPNet) {
+		return c.IPNet, nil
+	}
+	return nil, fmt.Errorf("type conversion error from '%s' to '%v'", CIDRType.TypeName(), typeDesc)
+}
+
+// ConvertToType implements the ref.Val interface method.
+func (c CIDR) ConvertToType(typeVal ref.Type) ref.Val {
+	switch typeVal {
+	case CIDRType:
+		return c
+	case types.StringType:
+		return types.String(c.IPNet.String())
+	case types.TypeType:
+		return CIDRType
+	}
+	return types.NewErr("type conversion error from '%s' to '%s'", CIDRType.TypeName(), typeVal.TypeName())
+}
+
+// Equal implements the ref.Val interface method.
+func (c CIDR) Equal(other ref.Val) ref.Val {
+	o, ok := other.(CIDR)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Bool(c.IPNet.String() == o.IPNet.String())
+}
+
+// Type implements the ref.Val interface method.
+func (c CIDR) Type() ref.Type {
+	return CIDRType
+}
+
+// Value implements the ref.Val interface method.
+func (c CIDR) Value() interface{} {
+	return c.IPNet
+}
+
+// contains returns true if other is within c and of the same family.
+func (c CIDR) contains(other *net.IPNet) bool {
+	ones, bits := c.IPNet.Mask.Size()
+	otherOnes, otherBits := other.Mask.Size()
+	return bits == otherBits && ones <= otherOnes && c.IPNet.Contains(other.IP)
+}
+
+type networkLib struct{}
+
+func (networkLib) CompileOptions() []cel.EnvOption {
+	member := func(name string, receiver, result *expr.Type) *expr.Decl {
+		return decls.NewFunction(name, decls.NewInstanceOverload(receiver.GetAbstractType().GetName()+"_"+name, []*expr.Type{receiver}, result))
+	}
+	global := func(name string, result *expr.Type) *expr.Decl {
+		return decls.NewFunction(name, decls.NewOverload(name+"_string", []*expr.Type{decls.String}, result))
+	}
+	cidrArg := func(name string, arg *expr.Type, argName string) *expr.Decl_FunctionDecl_Overload {
+		return decls.NewInstanceOverload("kubernetes.CIDR_"+name+"_"+argName, []*expr.Type{cidrDeclType, arg}, decls.Bool)
+	}
+	return []cel.EnvOption{
+		cel.Declarations(
+			global("url", urlDeclType),
+			global("isURL", decls.Bool),
+			member("getScheme", urlDeclType, decls.String),
+			member("getHost", urlDeclType, decls.String),
+			member("getHostname", urlDeclType, decls.String),
+			member("getPort", urlDeclType, decls.String),
+			member("getEscapedPath", urlDeclType, decls.String),
+			member("getQuery", urlDeclType, decls.NewMapType(decls.String, decls.NewListType(decls.String))),
+
+			global("ip", ipDeclType),
+			global("isIP", decls.Bool),
+			member("family", ipDeclType, decls.Int),
+			member("isLoopback", ipDeclType, decls.Bool),
+			member("isUnspecified", ipDeclType, decls.Bool),
+
+			global("cidr", cidrDeclType),
+			global("isCIDR", decls.Bool),
+			member("ip", cidrDeclType, ipDeclType),
+			member("prefixLength", cidrDeclType, decls.Int),
+			decls.NewFunction("containsIP",
+				cidrArg("containsIP", ipDeclType, "ip"),
+				cidrArg("containsIP", decls.String, "string")),
+			decls.NewFunction("containsCIDR",
+				cidrArg("containsCIDR", cidrDeclType, "cidr"),
+				cidrArg("containsCIDR", decls.String, "string")),
+			decls.NewFunction("overlaps",
+				cidrArg("overlaps", cidrDeclType, "cidr"),
+				cidrArg("overlaps", decls.String, "string")),
+		),
+	}
+}
+
+func (networkLib) ProgramOptions() []cel.ProgramOption {
+	// ip is both a global function parsing strings and a member function of CIDRs, so overloads are
+	// registered by overload id rather than function name.
+	return []cel.ProgramOption{
+		cel.Functions(
+			&functions.Overload{Operator: "url_string", Unary: stringFunc(parseURL)},
+			&functions.Overload{Operator: "isURL_string", Unary: stringFunc(func(s string) ref.Val {
+				return types.Bool(checkURL(s) == nil)
+			})},
+			&functions.Overload{Operator: "kubernetes.URL_getScheme", Unary: urlFunc(func(u *url.URL) ref.Val { return types.String(u.Scheme) })},
+			&functions.Overload{Operator: "kubernetes.URL_getHost", Unary: urlFunc(func(u *url.URL) ref.Val { return types.String(u.Host) })},
+			&functions.Overload{Operator: "kubernetes.URL_getHostname", Unary: urlFunc(func(u *url.URL) ref.Val { return types.String(u.Hostname()) })},
+			&functions.Overload{Operator: "kubernetes.URL_getPort", Unary: urlFunc(func(u *url.URL) ref.Val { return types.String(u.Port()) })},
+			&functions.Overload{Operator: "kubernetes.URL_getEscapedPath", Unary: urlFunc(func(u *url.URL) ref.Val { return types.String(u.EscapedPath()) })},
+			&functions.Overload{Operator: "kubernetes.URL_getQuery", Unary: urlFunc(func(u *url.URL) ref.Val {
+				return types.DefaultTypeAdapter.NativeToValue(map[string][]string(u.Query()))
+			})},
+
+			&functions.Overload{Operator: "ip_string", Unary: stringFunc(parseIP)},
+			&functions.Overload{Operator: "isIP_string", Unary: stringFunc(func(s string) ref.Val {
+				return types.Bool(checkIP(s) == nil)
+			})},
+			&functions.Overload{Operator: "kubernetes.IP_family", Unary: ipFunc(func(ip net.IP) ref.Val {
+				if ip.To4() != nil {
+					return types.Int(4)
+				}
+				return types.Int(6)
+			})},
+			&functions.Overload{Operator: "kubernetes.IP_isLoopback", Unary: ipFunc(func(ip net.IP) ref.Val { return types.Bool(ip.IsLoopback()) })},
+			&functions.Overload{Operator: "kubernetes.IP_isUnspecified", Unary: ipFunc(func(ip net.IP) ref.Val { return types.Bool(ip.IsUnspecified()) })},
+
+			&functions.Overload{Operator: "cidr_string", Unary: stringFunc(parseCIDR)},
+			&functions.Overload{Operator: "isCIDR_string", Unary: stringFunc(func(s string) ref.Val {
+				return types.Bool(checkCIDR(s) == nil)
+			})},
+			&functions.Overload{Operator: "kubernetes.CIDR_ip", Unary: func(value ref.Val) ref.Val {
+				c, ok := value.(CIDR)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(value)
+				}
+				return IP{IP: c.IPNet.IP}
+			}},
+			&functions.Overload{Operator: "kubernetes.CIDR_prefixLength", Unary: func(value ref.Val) ref.Val {
+				c, ok := value.(CIDR)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(value)
+				}
+				ones, _ := c.IPNet.Mask.Size()
+				return types.Int(ones)
+			}},
+			// The overloads taking a parsed value or a string are implemented together, since the
+			// overload cannot be chosen at compile time for dynamically typed arguments.
+			&functions.Overload{Operator: "containsIP", Binary: cidrContainsIP},
+			&functions.Overload{Operator: "containsCIDR", Binary: cidrContainsCIDR},
+			&functions.Overload{Operator: "overlaps", Binary: cidrOverlaps},
+		),
+	}
+}
+
+func checkURL(s string) error {
+	_, err := url.ParseRequestURI(s)
+	return err
+}
+
+func checkIP(s string) error {
+	if net.ParseIP(s) == nil {
+		return fmt.Errorf("%q is not a valid IP address", s)
+	}
+	return nil
+}
+
+func checkCIDR(s string) error {
+	_, _, err := net.ParseCIDR(s)
+	return err
+}
+
+func parseURL(s string) ref.Val {
+	u, err := url.ParseRequestURI(s)
+	if err != nil {
+		return types.NewErr("invalid URL: %v", err)
+	}
+	return URL{URL: u}
+}
+
+func parseIP(s string) ref.Val {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return types.NewErr("invalid IP address: %q", s)
+	}
+	return IP{IP: ip}
+}
+
+func parseCIDR(s string) ref.Val {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return types.NewErr("invalid CIDR: %v", err)
+	}
+	return CIDR{IPNet: ipNet}
+}
+
+// stringFunc adapts a function of a string to a unary overload.
+func stringFunc(f func(string) ref.Val) functions.UnaryOp {
+	return func(value ref.Val) ref.Val {
+		s, ok := value.(types.String)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(value)
+		}
+		return f(string(s))
+	}
+}
+
+func urlFunc(f func(*url.URL) ref.Val) functions.UnaryOp {
+	return func(value ref.Val) ref.Val {
+		u, ok := value.(URL)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(value)
+		}
+		return f(u.URL)
+	}
+}
+
+func ipFunc(f func(net.IP) ref.Val) functions.UnaryOp {
+	return func(value ref.Val) ref.Val {
+		ip, ok := value.(IP)
+		if !ok {
+			return types.MaybeNoSuchOverloadErr(value)
+		}
+		return f(ip.IP)
+	}
+}
+
+func cidrContainsIP(lhs, rhs ref.Val) ref.Val {
+	c, ok := lhs.(CIDR)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(lhs)
+	}
+	if str, ok := rhs.(types.String); ok {
+		rhs = parseIP(string(str))
+	}
+	ip, ok := rhs.(IP)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(rhs)
+	}
+	bits := 8 * net.IPv6len
+	if ip.IP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	return types.Bool(c.contains(&net.IPNet{IP: ip.IP, Mask: net.CIDRMask(bits, bits)}))
+}
+
+func cidrContainsCIDR(lhs, rhs ref.Val) ref.Val {
+	c, ok := lhs.(CIDR)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(lhs)
+	}
+	if str, ok := rhs.(types.String); ok {
+		rhs = parseCIDR(string(str))
+	}
+	o, ok := rhs.(CIDR)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(rhs)
+	}
+	return types.Bool(c.contains(o.IPNet))
+}
+
+func cidrOverlaps(lhs, rhs ref.Val) ref.Val {
+	c, ok := lhs.(CIDR)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(lhs)
+	}
+	if str, ok := rhs.(types.String); ok {
+		rhs = parseCIDR(string(str))
+	}
+	o, ok := rhs.(CIDR)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(rhs)
+	}
+	// Two CIDRs overlap if and only if one contains the other.
+	return types.Bool(c.contains(o.IPNet) || o.contains(c.IPNet))
+}
@@ -0,0 +1,30 @@
+package validators
+
+import "testing"
+
+func TestNetwork(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{
+			"endpoint":{"type":"string"},
+			"pod":{"type":"string"},
+			"gateway":{"type":"string"},
+			"services":{"type":"array","maxItems":10,"items":{"type":"string","maxLength":64}},
+			"any":{"x-kubernetes-int-or-string":true}}}`,
+		`{"endpoint":"https://example.com:8443/a%20b?x=1&x=2","pod":"10.0.0.0/16","gateway":"10.0.1.1","services":["10.1.0.0/16","192.168.0.0/24"],"any":"10.0.0.0/8"}`, "",
+		[]ruleTest{
+			{rule: "url(self.endpoint).getScheme() == 'https' && url(self.endpoint).getHost() == 'example.com:8443' && url(self.endpoint).getHostname() == 'example.com' && url(self.endpoint).getPort() == '8443'"},
+			{rule: "url(self.endpoint).getEscapedPath() == '/a%20b' && url(self.endpoint).getQuery()['x'] == ['1', '2']"},
+			{rule: "isURL('/path') && !isURL('rel')"},
+			{rule: "ip('::1').family() == 6 && ip('1.2.3.4').family() == 4 && ip('127.0.0.1').isLoopback() && ip('0.0.0.0').isUnspecified()"},
+			{rule: "isIP('::') && !isIP('x') && isCIDR('::/0') && !isCIDR('1.2.3.4')"},
+			{rule: "cidr('10.0.0.1/8').ip() == ip('10.0.0.0') && cidr('10.0.0.0/8').prefixLength() == 8"},
+			{rule: "cidr(self.pod).containsIP(self.gateway) && cidr(self.pod).containsIP(ip(self.gateway)) && !cidr(self.pod).containsIP('::1')"},
+			{rule: "cidr('10.0.0.0/8').containsCIDR(self.pod) && !cidr(self.pod).containsCIDR('10.0.0.0/8')"},
+			{rule: "!self.services.exists(c, cidr(c).overlaps(self.pod)) && cidr(self.any).overlaps(self.pod)"},
+			{rule: "cidr(self.pod).containsIP('10.1.0.1')", err: "failed validation rule"},
+			{rule: "cidr(self.pod).containsCIDR(self.gateway)", err: "evaluation error"},
+			{rule: "url('not a url').getScheme() == ''", compileErr: true},
+			{rule: "ip('1.2.3') == ip('1.2.3.4')", compileErr: true},
+			{rule: "cidr(self.pod).containsCIDR('x')", compileErr: true},
+		})
+}
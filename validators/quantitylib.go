@@ -0,0 +1,248 @@
+package validators
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter/functions"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Quantities returns a cel.EnvOption declaring the kubernetes.Quantity type, parsed from strings with
+// the same syntax as resource requests and limits, and the functions that operate on it.
+//
+//	quantity(<string>) -> <kubernetes.Quantity>
+//	isQuantity(<string>) -> <bool>
+//	<kubernetes.Quantity>.asInteger() -> <int>
+//	<kubernetes.Quantity>.asApproximateFloat() -> <double>
+//	<kubernetes.Quantity>.sign() -> <int>
+//
+// Quantities are compared with ==, !=, <, <=, > and >=, and added and subtracted with + and -.
+// asInteger returns an error if the quantity is not an integer or does not fit in an int.
+//
+// Examples:
+//
+//	quantity(self.limit) >= quantity(self.request)
+//	quantity('1Gi') == quantity('1024Mi')          // returns true
+//	(quantity('1') + quantity('500m')).asApproximateFloat()  // returns 1.5
+func Quantities() cel.EnvOption {
+	return cel.Lib(quantityLib{})
+}
+
+// QuantityType is the CEL type of Quantity values.
+var QuantityType = types.NewTypeValue("kubernetes.Quantity",
+	traits.ComparerType,
+	traits.AdderType,
+	traits.SubtractorType)
+
+var quantityDeclType = decls.NewAbstractType(QuantityType.TypeName())
+
+// Quantity is the CEL value of a resource.Quantity.
+type Quantity struct {
+	*resource.Quantity
+}
+
+var quantityNativeType = reflect.TypeOf(&resource.Quantity{})
+
+// ConvertToNative implements the ref.Val interface method.
+func (q Quantity) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	switch typeDesc {
+	case quantityNativeType:
+		return q.Quantity, nil
+	case quantityNativeType.Elem():
+		return *q.Quantity, nil
+	}
+	return nil, fmt.Errorf("type conversion error from '%s' to '%v'", QuantityType.TypeName(), typeDesc)
+}
+
+// ConvertToType implements the ref.Val interface method.
+func (q Quantity) ConvertToType(typeVal ref.Type) ref.Val {
+	switch typeVal {
+	case QuantityType:
+		return q
+	case types.StringType:
+		return types.String(q.Quantity.String())
+	case types.TypeType:
+		return QuantityType
+	}
+	return types.NewErr("type conversion error from '%s' to '%s'", QuantityType.TypeName(), typeVal.TypeName())
+}
+
+// Equal implements the ref.Val interface method.
+func (q Quantity) Equal(other ref.Val) ref.Val {
+	o, ok := other.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Bool(q.Quantity.Cmp(*o.Quantity) == 0)
+}
+
+// Type implements the ref.Val interface method.
+func (q Quantity) Type() ref.Type {
+	return QuantityType
+}
+
+// Value implements the ref.Val interface method.
+func (q Quantity) Value() interface{} {
+	return q.Quantity
+}
+
+// Compare implements the traits.Comparer interface method.
+func (q Quantity) Compare(other ref.Val) ref.Val {
+	o, ok := other.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Int(q.Quantity.Cmp(*o.Quantity))
+}
+
+// Add implements the traits.Adder interface method.
+func (q Quantity) Add(other ref.Val) ref.Val {
+	o, ok := other.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	sum := q.Quantity.DeepCopy()
+	sum.Add(*o.Quantity)
+	return Quantity{Quantity: &sum}
+}
+
+// Subtract implements the traits.Subtractor interface method.
+func (q Quantity) Subtract(other ref.Val) ref.Val {
+	o, ok := other.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	difference := q.Quantity.DeepCopy()
+	difference.Sub(*o.Quantity)
+	return Quantity{Quantity: &difference}
+}
+
+type quantityLib struct{}
+
+func (quantityLib) CompileOptions() []cel.EnvOption {
+	binary := func(function, overload string, result *expr.Type) *expr.Decl {
+		return decls.NewFunction(function,
+			decls.NewOverload(overload, []*expr.Type{quantityDeclType, quantityDeclType}, result))
+	}
+	return []cel.EnvOption{
+		cel.Declarations(
+			decls.NewFunction("quantity",
+				decls.NewOverload("quantity_string", []*expr.Type{decls.String}, quantityDeclType)),
+			decls.NewFunction("isQuantity",
+				decls.NewOverload("isQuantity_string", []*expr.Type{decls.String}, decls.Bool)),
+			decls.NewFunction("asInteger",
+				decls.NewInstanceOverload("quantity_asInteger", []*expr.Type{quantityDeclType}, decls.Int)),
+			decls.NewFunction("asApproximateFloat",
+				decls.NewInstanceOverload("quantity_asApproximateFloat", []*expr.Type{quantityDeclType}, decls.Double)),
+			decls.NewFunction("sign",
+				decls.NewInstanceOverload("quantity_sign", []*expr.Type{quantityDeclType}, decls.Int)),
+			binary(operators.Less, "less_quantity", decls.Bool),
+			binary(operators.LessEquals, "less_equals_quantity", decls.Bool),
+			binary(operators.Greater, "greater_quantity", decls.Bool),
+			binary(operators.GreaterEquals, "greater_equals_quantity", decls.Bool),
+			binary(operators.Add, "add_quantity", quantityDeclType),
+			binary(operators.Subtract, "subtract_quantity", quantityDeclType),
+		),
+	}
+}
+
+func (quantityLib) ProgramOptions() []cel.ProgramOption {
+	compare := func(overload string, test func(int) bool) *functions.Overload {
+		return &functions.Overload{
+			Operator: overload,
+			Binary: func(lhs, rhs ref.Val) ref.Val {
+				q, ok := lhs.(Quantity)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(lhs)
+				}
+				cmp, ok := q.Compare(rhs).(types.Int)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(rhs)
+				}
+				return types.Bool(test(int(cmp)))
+			},
+		}
+	}
+	return []cel.ProgramOption{
+		cel.Functions(
+			&functions.Overload{Operator: "quantity", Unary: parseQuantity},
+			&functions.Overload{Operator: "isQuantity", Unary: isQuantity},
+			&functions.Overload{Operator: "asInteger", Unary: quantityAsInteger},
+			&functions.Overload{Operator: "asApproximateFloat", Unary: quantityAsApproximateFloat},
+			&functions.Overload{Operator: "sign", Unary: quantitySign},
+			compare("less_quantity", func(cmp int) bool { return cmp < 0 }),
+			compare("less_equals_quantity", func(cmp int) bool { return cmp <= 0 }),
+			compare("greater_quantity", func(cmp int) bool { return cmp > 0 }),
+			compare("greater_equals_quantity", func(cmp int) bool { return cmp >= 0 }),
+			&functions.Overload{Operator: "add_quantity", Binary: func(lhs, rhs ref.Val) ref.Val {
+				if q, ok := lhs.(Quantity); ok {
+					return q.Add(rhs)
+				}
+				return types.MaybeNoSuchOverloadErr(lhs)
+			}},
+			&functions.Overload{Operator: "subtract_quantity", Binary: func(lhs, rhs ref.Val) ref.Val {
+				if q, ok := lhs.(Quantity); ok {
+					return q.Subtract(rhs)
+				}
+				return types.MaybeNoSuchOverloadErr(lhs)
+			}},
+		),
+	}
+}
+
+func parseQuantity(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	q, err := resource.ParseQuantity(string(s))
+	if err != nil {
+		return types.NewErr("invalid quantity %q: %v", string(s), err)
+	}
+	return Quantity{Quantity: &q}
+}
+
+func isQuantity(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	_, err := resource.ParseQuantity(string(s))
+	return types.Bool(err == nil)
+}
+
+func quantityAsInteger(value ref.Val) ref.Val {
+	q, ok := value.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	i, ok := q.Quantity.AsInt64()
+	if !ok {
+		return types.NewErr("quantity %s cannot be represented as an int", q.Quantity.String())
+	}
+	return types.Int(i)
+}
+
+func quantityAsApproximateFloat(value ref.Val) ref.Val {
+	q, ok := value.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	return types.Double(q.Quantity.AsApproximateFloat64())
+}
+
+func quantitySign(value ref.Val) ref.Val {
+	q, ok := value.(Quantity)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	return types.Int(q.Quantity.Sign())
+}
@@ -0,0 +1,21 @@
+package validators
+
+import "testing"
+
+func TestQuantities(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"limit":{"type":"string"},"request":{"type":"string"}}}`,
+		`{"limit":"1Gi","request":"2000Mi"}`, "",
+		[]ruleTest{
+			{rule: "quantity('1Gi') == quantity('1024Mi') && quantity('1') != quantity('2')"},
+			{rule: "quantity('2') > quantity('1500m') && quantity('1k') >= quantity('1000') && quantity('1m') < quantity('1')"},
+			{rule: "(quantity('1') + quantity('500m')).asApproximateFloat() == 1.5"},
+			{rule: "quantity('2') - quantity('500m') == quantity('1500m')"},
+			{rule: "quantity('2k').asInteger() == 2000"},
+			{rule: "quantity('-1').sign() == -1 && quantity('0').sign() == 0"},
+			{rule: "isQuantity('1Gi') && !isQuantity('1x')"},
+			{rule: "quantity(self.limit) >= quantity(self.request)", err: "failed validation rule"},
+			{rule: "quantity('bad') > quantity('1')", err: "evaluation error"},
+			{rule: "quantity('1') < 1", compileErr: true},
+		})
+}
@@ -0,0 +1,102 @@
+package validators
+
+import (
+	"regexp"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Regex returns a cel.EnvOption declaring functions that extract the matches of RE2 regular
+// expressions from strings. Constant patterns are checked when rules are compiled.
+//
+//	<string>.find(<string>) -> <string>
+//	<string>.findAll(<string>) -> <list<string>>
+//	<string>.findAll(<string>, <int>) -> <list<string>>
+//
+// find returns the first match of the pattern, or the empty string if there is none. findAll returns
+// all matches, or at most the given number of matches if it is not negative.
+//
+// Examples:
+//
+//	'abc 123'.find('[0-9]+')          // returns '123'
+//	'1, 2, 3'.findAll('[0-9]+', 2)    // returns ['1', '2']
+func Regex() cel.EnvOption {
+	return cel.Lib(regexLib{})
+}
+
+type regexLib struct{}
+
+func (regexLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.Declarations(
+			decls.NewFunction("find",
+				decls.NewInstanceOverload("string_find_string", []*expr.Type{decls.String, decls.String}, decls.String)),
+			decls.NewFunction("findAll",
+				decls.NewInstanceOverload("string_findAll_string", []*expr.Type{decls.String, decls.String}, decls.NewListType(decls.String)),
+				decls.NewInstanceOverload("string_findAll_string_int", []*expr.Type{decls.String, decls.String, decls.Int}, decls.NewListType(decls.String))),
+		),
+	}
+}
+
+func (regexLib) ProgramOptions() []cel.ProgramOption {
+	return []cel.ProgramOption{
+		cel.Functions(
+			&functions.Overload{Operator: "find", Binary: find},
+			&functions.Overload{Operator: "string_findAll_string", Binary: func(s, pattern ref.Val) ref.Val {
+				return findAll(s, pattern, types.Int(-1))
+			}},
+			&functions.Overload{Operator: "string_findAll_string_int", Function: func(args ...ref.Val) ref.Val {
+				if len(args) != 3 {
+					return types.NoSuchOverloadErr()
+				}
+				return findAll(args[0], args[1], args[2])
+			}},
+		),
+	}
+}
+
+func checkRegex(pattern string) error {
+	_, err := regexp.Compile(pattern)
+	return err
+}
+
+func find(value, pattern ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	p, ok := pattern.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(pattern)
+	}
+	re, err := regexp.Compile(string(p))
+	if err != nil {
+		return types.NewErr("invalid regular expression %q: %v", string(p), err)
+	}
+	return types.String(re.FindString(string(s)))
+}
+
+func findAll(value, pattern, limit ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	p, ok := pattern.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(pattern)
+	}
+	n, ok := limit.(types.Int)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(limit)
+	}
+	re, err := regexp.Compile(string(p))
+	if err != nil {
+		return types.NewErr("invalid regular expression %q: %v", string(p), err)
+	}
+	return types.NewStringList(types.DefaultTypeAdapter, re.FindAllString(string(s), int(n)))
+}
@@ -0,0 +1,17 @@
+package validators
+
+import "testing"
+
+func TestRegex(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"s":{"type":"string"},"pattern":{"type":"string"}}}`,
+		`{"s":"1, 2, 3","pattern":"["}`, "",
+		[]ruleTest{
+			{rule: "'abc 123'.find('[0-9]+') == '123' && 'abc'.find('[0-9]+') == ''"},
+			{rule: "self.s.findAll('[0-9]+') == ['1', '2', '3']"},
+			{rule: "self.s.findAll('[0-9]+', 2) == ['1', '2'] && self.s.findAll('[0-9]+', -1).size() == 3"},
+			{rule: "self.s.find('[0-9]+') == '2'", err: "failed validation rule"},
+			{rule: "self.s.find(self.pattern) == ''", err: "evaluation error"},
+			{rule: "'a'.find('[')", compileErr: true},
+		})
+}
@@ -0,0 +1,226 @@
+package validators
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/blang/semver/v4"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter/functions"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Semvers returns a cel.EnvOption declaring the kubernetes.Semver type, parsed from semantic version
+// strings such as '1.2.3' or '1.2.3-rc.1+build.5', and the functions that operate on it. Constant
+// arguments to semver and inRange are checked when rules are compiled.
+//
+//	semver(<string>) -> <kubernetes.Semver>
+//	isSemver(<string>) -> <bool>
+//	<kubernetes.Semver>.major() -> <int>
+//	<kubernetes.Semver>.minor() -> <int>
+//	<kubernetes.Semver>.patch() -> <int>
+//	<kubernetes.Semver>.inRange(<string>) -> <bool>
+//
+// Versions are compared with ==, !=, <, <=, > and >= following semver precedence, so build metadata
+// is ignored and pre-releases sort before their release. Versions must have all three components and
+// no 'v' prefix. Ranges are comparisons such as '>=1.2.0 <2.0.0', joined by spaces for AND and by
+// '||' for OR; '1.2.x' matches any patch of 1.2.
+//
+// Examples:
+//
+//	semver(self.version) >= semver('1.20.0')
+//	semver(self.version).inRange('>=1.0.0 <2.0.0 || 3.x')
+//	semver(self.version).minor() <= semver(oldSelf.version).minor() + 1
+func Semvers() cel.EnvOption {
+	return cel.Lib(semverLib{})
+}
+
+// SemverType is the CEL type of Semver values.
+var SemverType = types.NewTypeValue("kubernetes.Semver", traits.ComparerType)
+
+var semverDeclType = decls.NewAbstractType(SemverType.TypeName())
+
+// Semver is the CEL value of a semver.Version.
+type Semver struct {
+	semver.Version
+}
+
+var semverNativeType = reflect.TypeOf(semver.Version{})
+
+// ConvertToNative implements the ref.Val interface method.
+func (v Semver) ConvertToNative(typeDesc reflect.Type) (interface{}, error) {
+	switch typeDesc {
+	case semverNativeType:
+		return v.Version, nil
+	case reflect.PtrTo(semverNativeType):
+		return &v.Version, nil
+	}
+	return nil, fmt.Errorf("type conversion error from '%s' to '%v'", SemverType.TypeName(), typeDesc)
+}
+
+// ConvertToType implements the ref.Val interface method.
+func (v Semver) ConvertToType(typeVal ref.Type) ref.Val {
+	switch typeVal {
+	case SemverType:
+		return v
+	case types.StringType:
+		return types.String(v.Version.String())
+	case types.TypeType:
+		return SemverType
+	}
+	return types.NewErr("type conversion error from '%s' to '%s'", SemverType.TypeName(), typeVal.TypeName())
+}
+
+// Equal implements the ref.Val interface method.
+func (v Semver) Equal(other ref.Val) ref.Val {
+	o, ok := other.(Semver)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Bool(v.Version.Compare(o.Version) == 0)
+}
+
+// Type implements the ref.Val interface method.
+func (v Semver) Type() ref.Type {
+	return SemverType
+}
+
+// Value implements the ref.Val interface method.
+func (v Semver) Value() interface{} {
+	return v.Version
+}
+
+// Compare implements the traits.Comparer interface method.
+func (v Semver) Compare(other ref.Val) ref.Val {
+	o, ok := other.(Semver)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(other)
+	}
+	return types.Int(v.Version.Compare(o.Version))
+}
+
+type semverLib struct{}
+
+func (semverLib) CompileOptions() []cel.EnvOption {
+	compare := func(function, overload string) *expr.Decl {
+		return decls.NewFunction(function,
+			decls.NewOverload(overload, []*expr.Type{semverDeclType, semverDeclType}, decls.Bool))
+	}
+	component := func(function string) *expr.Decl {
+		return decls.NewFunction(function,
+			decls.NewInstanceOverload("semver_"+function, []*expr.Type{semverDeclType}, decls.Int))
+	}
+	return []cel.EnvOption{
+		cel.Declarations(
+			decls.NewFunction("semver",
+				decls.NewOverload("semver_string", []*expr.Type{decls.String}, semverDeclType)),
+			decls.NewFunction("isSemver",
+				decls.NewOverload("isSemver_string", []*expr.Type{decls.String}, decls.Bool)),
+			component("major"),
+			component("minor"),
+			component("patch"),
+			decls.NewFunction("inRange",
+				decls.NewInstanceOverload("semver_inRange_string", []*expr.Type{semverDeclType, decls.String}, decls.Bool)),
+			compare(operators.Less, "less_semver"),
+			compare(operators.LessEquals, "less_equals_semver"),
+			compare(operators.Greater, "greater_semver"),
+			compare(operators.GreaterEquals, "greater_equals_semver"),
+		),
+	}
+}
+
+func (semverLib) ProgramOptions() []cel.ProgramOption {
+	compare := func(overload string, test func(int) bool) *functions.Overload {
+		return &functions.Overload{
+			Operator: overload,
+			Binary: func(lhs, rhs ref.Val) ref.Val {
+				v, ok := lhs.(Semver)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(lhs)
+				}
+				cmp, ok := v.Compare(rhs).(types.Int)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(rhs)
+				}
+				return types.Bool(test(int(cmp)))
+			},
+		}
+	}
+	component := func(function string, get func(semver.Version) uint64) *functions.Overload {
+		return &functions.Overload{
+			Operator: function,
+			Unary: func(value ref.Val) ref.Val {
+				v, ok := value.(Semver)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(value)
+				}
+				return types.Int(get(v.Version))
+			},
+		}
+	}
+	return []cel.ProgramOption{
+		cel.Functions(
+			&functions.Overload{Operator: "semver", Unary: parseSemver},
+			&functions.Overload{Operator: "isSemver", Unary: isSemver},
+			component("major", func(v semver.Version) uint64 { return v.Major }),
+			component("minor", func(v semver.Version) uint64 { return v.Minor }),
+			component("patch", func(v semver.Version) uint64 { return v.Patch }),
+			&functions.Overload{Operator: "inRange", Binary: semverInRange},
+			compare("less_semver", func(cmp int) bool { return cmp < 0 }),
+			compare("less_equals_semver", func(cmp int) bool { return cmp <= 0 }),
+			compare("greater_semver", func(cmp int) bool { return cmp > 0 }),
+			compare("greater_equals_semver", func(cmp int) bool { return cmp >= 0 }),
+		),
+	}
+}
+
+func parseSemver(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	v, err := semver.Parse(string(s))
+	if err != nil {
+		return types.NewErr("invalid semantic version %q: %v", string(s), err)
+	}
+	return Semver{Version: v}
+}
+
+func isSemver(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	return types.Bool(checkSemver(string(s)) == nil)
+}
+
+func semverInRange(lhs, rhs ref.Val) ref.Val {
+	v, ok := lhs.(Semver)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(lhs)
+	}
+	s, ok := rhs.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(rhs)
+	}
+	r, err := semver.ParseRange(string(s))
+	if err != nil {
+		return types.NewErr("invalid semantic version range %q: %v", string(s), err)
+	}
+	return types.Bool(r(v.Version))
+}
+
+func checkSemver(s string) error {
+	_, err := semver.Parse(s)
+	return err
+}
+
+func checkSemverRange(s string) error {
+	_, err := semver.ParseRange(s)
+	return err
+}
@@ -0,0 +1,20 @@
+package validators
+
+import "testing"
+
+func TestSemver(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"v":{"type":"string"},"r":{"type":"string"}}}`,
+		`{"v":"1.21.3","r":">>1"}`, `{"v":"1.20.0","r":">>1"}`,
+		[]ruleTest{
+			{rule: "semver(self.v) > semver('1.20.0') && semver('1.0.0-rc.1') < semver('1.0.0') && semver('1.0.0+a') == semver('1.0.0+b')"},
+			{rule: "semver(self.v).major() == 1 && semver(self.v).minor() == 21 && semver(self.v).patch() == 3"},
+			{rule: "semver(self.v).inRange('>=1.0.0 <2.0.0 || 3.x') && !semver(self.v).inRange('1.20.x')"},
+			{rule: "isSemver(self.v) && !isSemver('v1.2.3') && !isSemver('1.2')"},
+			{rule: "semver(self.v).minor() <= semver(oldSelf.v).minor() + 1"},
+			{rule: "semver(self.v) == semver(oldSelf.v)", err: "failed validation rule"},
+			{rule: "semver(self.v).inRange(self.r)", err: "evaluation error"},
+			{rule: "semver('v1') == semver('1.0.0')", compileErr: true},
+			{rule: "semver(self.v).inRange('>>1')", compileErr: true},
+		})
+}
@@ -0,0 +1,70 @@
+package validators
+
+import (
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Times returns a cel.EnvOption declaring functions that check whether strings can be parsed by the
+// standard duration and timestamp functions, which parse Go durations and RFC3339 timestamps, the
+// format of strings with the date-time format. Parsing an invalid string is an evaluation error, so
+// these allow rules to report invalid values as failures instead.
+//
+//	isDuration(<string>) -> <bool>
+//	isTimestamp(<string>) -> <bool>
+//
+// Examples:
+//
+//	isDuration(self.timeout) && duration(self.timeout) <= duration('1h')
+//	timestamp(self.endTime) > timestamp(self.startTime)
+func Times() cel.EnvOption {
+	return cel.Lib(timeLib{})
+}
+
+type timeLib struct{}
+
+func (timeLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.Declarations(
+			decls.NewFunction("isDuration",
+				decls.NewOverload("isDuration_string", []*expr.Type{decls.String}, decls.Bool)),
+			decls.NewFunction("isTimestamp",
+				decls.NewOverload("isTimestamp_string", []*expr.Type{decls.String}, decls.Bool)),
+		),
+	}
+}
+
+func (timeLib) ProgramOptions() []cel.ProgramOption {
+	return []cel.ProgramOption{
+		cel.Functions(
+			&functions.Overload{
+				Operator: "isDuration",
+				Unary: func(value ref.Val) ref.Val {
+					s, ok := value.(types.String)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(value)
+					}
+					_, err := time.ParseDuration(string(s))
+					return types.Bool(err == nil)
+				},
+			},
+			&functions.Overload{
+				Operator: "isTimestamp",
+				Unary: func(value ref.Val) ref.Val {
+					s, ok := value.(types.String)
+					if !ok {
+						return types.MaybeNoSuchOverloadErr(value)
+					}
+					_, err := time.Parse(time.RFC3339, string(s))
+					return types.Bool(err == nil)
+				},
+			},
+		),
+	}
+}
@@ -0,0 +1,18 @@
+package validators
+
+import "testing"
+
+func TestDurationsAndTimestamps(t *testing.T) {
+	testRules(t, NewCelValidator(),
+		`{"type":"object","properties":{"start":{"type":"string","format":"date-time"},"end":{"type":"string","format":"date-time"},"timeout":{"type":"string"}}}`,
+		`{"start":"2021-01-01T00:00:00Z","end":"2021-01-02T00:00:00Z","timeout":"90m"}`, "",
+		[]ruleTest{
+			{rule: "timestamp(self.end) > timestamp(self.start)"},
+			{rule: "timestamp(self.end) - timestamp(self.start) == duration('24h')"},
+			{rule: "duration(self.timeout) > duration('1h') && duration(self.timeout) <= duration('2h')"},
+			{rule: "isDuration(self.timeout) && !isDuration('x')"},
+			{rule: "isTimestamp(self.start) && !isTimestamp('2021')"},
+			{rule: "duration(self.timeout) <= duration('1h')", err: "failed validation rule"},
+			{rule: "duration('x') > duration('1h')", err: "evaluation error"},
+		})
+}
@@ -0,0 +1,442 @@
+package validators
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	expr "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// celReservedSymbols are the CEL keywords and reserved words that cannot be used as identifiers.
+var celReservedSymbols = map[string]struct{}{
+	"true": {}, "false": {}, "null": {}, "in": {},
+	"as": {}, "break": {}, "const": {}, "continue": {}, "else": {},
+	"for": {}, "function": {}, "if": {}, "import": {}, "let": {},
+	"loop": {}, "package": {}, "namespace": {}, "return": {},
+	"var": {}, "void": {},
+}
+
+var celIdentRegex = regexp.MustCompile("^[_a-zA-Z][_a-zA-Z0-9]*$")
+
+// escapeName returns the CEL identifier used to access the property name. Property names that
+// collide with CEL keywords are wrapped in double underscores (e.g. "in" becomes "__in__"), and
+// '_', '.', '-' and '/' are escaped as "__underscores__", "__dot__", "__dash__" and "__slash__".
+// Returns false if the property name cannot be represented as a CEL identifier.
+func escapeName(name string) (string, bool) {
+	if _, ok := celReservedSymbols[name]; ok {
+		return "__" + name + "__", true
+	}
+	escaped := strings.NewReplacer(
+		"__", "__underscores__",
+		".", "__dot__",
+		"-", "__dash__",
+		"/", "__slash__",
+	).Replace(name)
+	return escaped, celIdentRegex.MatchString(escaped)
+}
+
+// objectType is a CEL message type backed by an object schema. Field names are escaped CEL
+// identifiers mapped to the property names used in the object.
+type objectType struct {
+	schema *apiextensionsv1.JSONSchemaProps
+	fields map[string]*ref.FieldType
+}
+
+// schemaTypeProvider exposes the objects described by an OpenAPIv3 schema to CEL as message types,
+// so that rules can select fields, test field presence with has() and traverse nested objects with
+// full type checking. Objects are represented at runtime by their unstructured
+// map[string]interface{} form. All other type lookups are delegated to the embedded provider.
+type schemaTypeProvider struct {
+	ref.TypeProvider
+	objectTypes map[string]*objectType
+	rootType    *expr.Type
+}
+
+// newSchemaTypeProvider creates a provider for the types of schema. Message type names are derived
+// from typeName, which must not be a valid CEL identifier so the types cannot be referenced by name
+// from rules.
+func newSchemaTypeProvider(typeName string, schema *apiextensionsv1.JSONSchemaProps) (*schemaTypeProvider, error) {
+	registry, err := types.NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	p := &schemaTypeProvider{
+		TypeProvider: registry,
+		objectTypes:  map[string]*objectType{},
+	}
+	p.rootType = p.buildType(typeName, schema)
+	return p, nil
+}
+
+// buildType returns the CEL type of values matching schema, registering message types for any
+// objects with declared properties.
+func (p *schemaTypeProvider) buildType(typeName string, schema *apiextensionsv1.JSONSchemaProps) *expr.Type {
+	if schema.XIntOrString {
+		return decls.Dyn
+	}
+	switch schema.Type {
+	case "object":
+		if schema.AdditionalProperties != nil && len(schema.Properties) == 0 {
+			if schema.AdditionalProperties.Schema == nil {
+				return decls.NewMapType(decls.String, decls.Dyn)
+			}
+			return decls.NewMapType(decls.String, p.buildType(typeName+"/@values", schema.AdditionalProperties.Schema))
+		}
+		if len(schema.Properties) == 0 {
+			return decls.NewMapType(decls.String, decls.Dyn)
+		}
+		t := &objectType{schema: schema, fields: map[string]*ref.FieldType{}}
+		p.objectTypes[typeName] = t
+		for propName, prop := range schema.Properties {
+			fieldName, ok := escapeName(propName)
+			if !ok {
+				continue
+			}
+			prop := prop
+			t.fields[fieldName] = newFieldType(propName, p.buildType(typeName+"/"+propName, &prop))
+		}
+		return decls.NewObjectType(typeName)
+	case "array":
+		if schema.Items == nil || schema.Items.Schema == nil {
+			return decls.NewListType(decls.Dyn)
+		}
+		return decls.NewListType(p.buildType(typeName+"/@items", schema.Items.Schema))
+	case "string":
+		return decls.String
+	case "integer":
+		return decls.Int
+	case "number":
+		return decls.Double
+	case "boolean":
+		return decls.Bool
+	default:
+		return decls.Dyn
+	}
+}
+
+// typeNameAt returns the name of the type buildType registers for the schema node at fieldpath,
+// relative to the root typeName. Array items and map values are identified by their position in
+// fieldpath, whatever the segment.
+func typeNameAt(typeName string, schema *apiextensionsv1.JSONSchemaProps, fieldpath []string) (string, error) {
+	for _, segment := range fieldpath {
+		switch {
+		case schema.Type == "array" && schema.Items != nil && schema.Items.Schema != nil:
+			typeName += "/@items"
+			schema = schema.Items.Schema
+		case schema.Type == "object" && len(schema.Properties) == 0 && schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil:
+			typeName += "/@values"
+			schema = schema.AdditionalProperties.Schema
+		default:
+			prop, ok := schema.Properties[segment]
+			if !ok {
+				return "", fmt.Errorf("no schema for field %s of %s", segment, strings.Join(fieldpath, "."))
+			}
+			typeName += "/" + segment
+			schema = &prop
+		}
+	}
+	return typeName, nil
+}
+
+func newFieldType(propName string, t *expr.Type) *ref.FieldType {
+	return &ref.FieldType{
+		Type: t,
+		IsSet: func(target interface{}) bool {
+			_, ok := lookupField(target, propName)
+			return ok
+		},
+		GetFrom: func(target interface{}) (interface{}, error) {
+			if value, ok := lookupField(target, propName); ok {
+				return value, nil
+			}
+			return nil, fmt.Errorf("no such key: %s", propName)
+		},
+	}
+}
+
+// lookupField returns the value of propName in an unstructured object. Null values are treated as
+// absent.
+func lookupField(target interface{}, propName string) (interface{}, bool) {
+	m, ok := target.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := m[propName]
+	if !ok || value == nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// FindType implements the ref.TypeProvider interface method.
+func (p *schemaTypeProvider) FindType(typeName string) (*expr.Type, bool) {
+	if _, ok := p.objectTypes[typeName]; ok {
+		return decls.NewTypeType(decls.NewObjectType(typeName)), true
+	}
+	return p.TypeProvider.FindType(typeName)
+}
+
+// FindFieldType implements the ref.TypeProvider interface method.
+func (p *schemaTypeProvider) FindFieldType(messageType string, fieldName string) (*ref.FieldType, bool) {
+	if t, ok := p.objectTypes[messageType]; ok {
+		ft, ok := t.fields[fieldName]
+		return ft, ok
+	}
+	return p.TypeProvider.FindFieldType(messageType, fieldName)
+}
+
+// NewValue implements the ref.TypeProvider interface method. Schema object types cannot be
+// constructed by rules.
+func (p *schemaTypeProvider) NewValue(typeName string, fields map[string]ref.Val) ref.Val {
+	if _, ok := p.objectTypes[typeName]; ok {
+		return types.NewErr("object type '%s' cannot be constructed", typeName)
+	}
+	return p.TypeProvider.NewValue(typeName, fields)
+}
+
+// adaptToSchema converts an unstructured value to the representation expected by the CEL types
+// derived from schema. JSON numbers without a fractional part are decoded as int64, so values of
+// number typed fields are widened to float64. Maps and lists are copied only if they contain values
+// that need conversion.
+func adaptToSchema(schema *apiextensionsv1.JSONSchemaProps, obj interface{}) interface{} {
+	out, _ := adapt(schema, obj)
+	return out
+}
+
+// adapt implements adaptToSchema, reporting whether obj was changed.
+func adapt(schema *apiextensionsv1.JSONSchemaProps, obj interface{}) (interface{}, bool) {
+	if schema == nil {
+		return obj, false
+	}
+	switch schema.Type {
+	case "number":
+		switch n := obj.(type) {
+		case int64:
+			return float64(n), true
+		case int:
+			return float64(n), true
+		}
+	case "object":
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return obj, false
+		}
+		var out map[string]interface{}
+		for key, value := range m {
+			var valueSchema *apiextensionsv1.JSONSchemaProps
+			if prop, ok := schema.Properties[key]; ok {
+				valueSchema = &prop
+			} else if schema.AdditionalProperties != nil {
+				valueSchema = schema.AdditionalProperties.Schema
+			}
+			if adapted, changed := adapt(valueSchema, value); changed {
+				if out == nil {
+					out = make(map[string]interface{}, len(m))
+					for k, v := range m {
+						out[k] = v
+					}
+				}
+				out[key] = adapted
+			}
+		}
+		if out != nil {
+			return out, true
+		}
+	case "array":
+		l, ok := obj.([]interface{})
+		if !ok || schema.Items == nil {
+			return obj, false
+		}
+		var out []interface{}
+		for i, item := range l {
+			if adapted, changed := adapt(schema.Items.Schema, item); changed {
+				if out == nil {
+					out = make([]interface{}, len(l))
+					copy(out, l)
+				}
+				out[i] = adapted
+			}
+		}
+		if out != nil {
+			return out, true
+		}
+	}
+	return obj, false
+}
+
+// scalarType returns the CEL type of the values of a string, integer or boolean schema, or nil for
+// any other schema. Integers are accepted for number schemas, so they have no single type.
+func scalarType(schema *apiextensionsv1.JSONSchemaProps) *expr.Type {
+	if schema.XIntOrString {
+		return nil
+	}
+	switch schema.Type {
+	case "string":
+		return decls.String
+	case "integer":
+		return decls.Int
+	case "boolean":
+		return decls.Bool
+	}
+	return nil
+}
+
+// CheckType checks that an unstructured value has the type declared by schema. Nested values are
+// not checked.
+func CheckType(schema *apiextensionsv1.JSONSchemaProps, value interface{}) error {
+	if schema.XIntOrString {
+		switch value.(type) {
+		case int64, string:
+			return nil
+		}
+		return fmt.Errorf("expected integer or string but got %T", value)
+	}
+	var ok bool
+	switch schema.Type {
+	case "string":
+		_, ok = value.(string)
+	case "integer":
+		_, ok = value.(int64)
+	case "number":
+		switch value.(type) {
+		case int64, float64:
+			ok = true
+		}
+	case "boolean":
+		_, ok = value.(bool)
+	case "object":
+		_, ok = value.(map[string]interface{})
+	case "array":
+		_, ok = value.([]interface{})
+	default:
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("expected %s but got %T", schema.Type, value)
+	}
+	return nil
+}
+
+// ConvertValue returns value, a value of the current schema, as a value of the target schema. Values
+// are only converted between schemas of compatible types: the same type, integer and number, integer
+// or string and int-or-string, or any type if either schema is untyped. Integers are widened to numbers
+// and whole numbers narrowed to integers, and other values are returned as is.
+func ConvertValue(current, target *apiextensionsv1.JSONSchemaProps, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	currentType, targetType := schemaTypeName(current), schemaTypeName(target)
+	if !compatibleTypes(currentType, targetType) {
+		return nil, fmt.Errorf("cannot convert %s to %s", currentType, targetType)
+	}
+	if f, ok := value.(float64); ok && target.Type == "integer" {
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, fmt.Errorf("cannot convert %v to integer without losing precision", f)
+		}
+		value = int64(f)
+	}
+	if err := CheckType(target, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// schemaTypeName returns the type of a schema as shown in errors.
+func schemaTypeName(schema *apiextensionsv1.JSONSchemaProps) string {
+	switch {
+	case schema.XIntOrString:
+		return "int-or-string"
+	case len(schema.Type) == 0:
+		return "any"
+	}
+	return schema.Type
+}
+
+func compatibleTypes(current, target string) bool {
+	switch {
+	case current == target, current == "any", target == "any":
+		return true
+	case current == "integer" || current == "number":
+		return target == "integer" || target == "number" || (current == "integer" && target == "int-or-string")
+	case current == "int-or-string":
+		return target == "integer" || target == "string"
+	case current == "string":
+		return target == "int-or-string"
+	}
+	return false
+}
+
+// SchemaAt returns the schema of the field at path, a list of property names, in an object schema.
+func SchemaAt(schema *apiextensionsv1.JSONSchemaProps, path []string) (*apiextensionsv1.JSONSchemaProps, error) {
+	for i, propName := range path {
+		prop, ok := schema.Properties[propName]
+		if !ok {
+			return nil, fmt.Errorf("no such field %s", strings.Join(path[:i+1], "."))
+		}
+		schema = &prop
+	}
+	return schema, nil
+}
+
+// toUnstructured converts a CEL value to its unstructured form. Values of types with no JSON
+// representation, such as timestamps, durations and quantities, are converted to strings.
+func toUnstructured(val ref.Val) (interface{}, error) {
+	switch v := val.(type) {
+	case *types.Err:
+		return nil, v
+	case types.Null:
+		return nil, nil
+	case types.Bool:
+		return bool(v), nil
+	case types.Int:
+		return int64(v), nil
+	case types.Uint:
+		if uint64(v) > math.MaxInt64 {
+			return nil, fmt.Errorf("%d does not fit in an integer", uint64(v))
+		}
+		return int64(v), nil
+	case types.Double:
+		return float64(v), nil
+	case types.String:
+		return string(v), nil
+	case types.Bytes:
+		return base64.StdEncoding.EncodeToString(v), nil
+	case traits.Mapper:
+		out := map[string]interface{}{}
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			key := it.Next()
+			k, ok := key.(types.String)
+			if !ok {
+				return nil, fmt.Errorf("expected string keys but got %s", key.Type().TypeName())
+			}
+			value, err := toUnstructured(v.Get(key))
+			if err != nil {
+				return nil, err
+			}
+			out[string(k)] = value
+		}
+		return out, nil
+	case traits.Lister:
+		out := []interface{}{}
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			item, err := toUnstructured(it.Next())
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, item)
+		}
+		return out, nil
+	}
+	if s, ok := val.ConvertToType(types.StringType).(types.String); ok {
+		return string(s), nil
+	}
+	return nil, fmt.Errorf("values of type %s cannot be converted to JSON", val.Type().TypeName())
+}
@@ -0,0 +1,65 @@
+package validators
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestConvertValue(t *testing.T) {
+	var (
+		str         = &apiextensionsv1.JSONSchemaProps{Type: "string"}
+		integer     = &apiextensionsv1.JSONSchemaProps{Type: "integer"}
+		number      = &apiextensionsv1.JSONSchemaProps{Type: "number"}
+		boolean     = &apiextensionsv1.JSONSchemaProps{Type: "boolean"}
+		object      = &apiextensionsv1.JSONSchemaProps{Type: "object"}
+		array       = &apiextensionsv1.JSONSchemaProps{Type: "array"}
+		intOrString = &apiextensionsv1.JSONSchemaProps{XIntOrString: true}
+		untyped     = &apiextensionsv1.JSONSchemaProps{}
+	)
+	tests := []struct {
+		name            string
+		current, target *apiextensionsv1.JSONSchemaProps
+		value           interface{}
+		expected        interface{}
+		expectedErr     string
+	}{
+		{name: "same type", current: str, target: str, value: "a", expected: "a"},
+		{name: "null", current: str, target: integer, value: nil, expected: nil},
+		{name: "integer to number", current: integer, target: number, value: int64(1), expected: int64(1)},
+		{name: "whole number to integer", current: number, target: integer, value: float64(2), expected: int64(2)},
+		{name: "fractional number to integer", current: number, target: integer, value: 2.5, expectedErr: "cannot convert 2.5 to integer without losing precision"},
+		{name: "huge number to integer", current: number, target: integer, value: 1e19, expectedErr: "without losing precision"},
+		{name: "integer to int-or-string", current: integer, target: intOrString, value: int64(1), expected: int64(1)},
+		{name: "string to int-or-string", current: str, target: intOrString, value: "1", expected: "1"},
+		{name: "int-or-string to integer", current: intOrString, target: integer, value: int64(1), expected: int64(1)},
+		{name: "int-or-string to string", current: intOrString, target: str, value: "1", expected: "1"},
+		{name: "int-or-string holding a string to integer", current: intOrString, target: integer, value: "1", expectedErr: "expected integer but got string"},
+		{name: "untyped to string", current: untyped, target: str, value: "a", expected: "a"},
+		{name: "untyped holding another type", current: untyped, target: str, value: int64(1), expectedErr: "expected string but got int64"},
+		{name: "any type to untyped", current: object, target: untyped, value: map[string]interface{}{}, expected: map[string]interface{}{}},
+		{name: "string to integer", current: str, target: integer, value: "1", expectedErr: "cannot convert string to integer"},
+		{name: "number to int-or-string", current: number, target: intOrString, value: 1.5, expectedErr: "cannot convert number to int-or-string"},
+		{name: "boolean to string", current: boolean, target: str, value: true, expectedErr: "cannot convert boolean to string"},
+		{name: "object to array", current: object, target: array, value: map[string]interface{}{}, expectedErr: "cannot convert object to array"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := ConvertValue(tc.current, tc.target, tc.value)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Errorf("expected error containing %q, got %v, %v", tc.expectedErr, value, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, tc.expected) {
+				t.Errorf("expected %#v, got %#v", tc.expected, value)
+			}
+		})
+	}
+}